@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/urjitbhatia/http-flytrap/internal"
+)
+
+var exportFormat string
+var exportURL string
+var exportOutput string
+var exportFilter = map[string]*string{}
+
+// exportCmd writes captured requests to a file, from the disk store or a running flytrap
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export captured requests",
+	Long: `Export writes captured requests in another format, eg: HAR for browser devtools, or JSONL for a snapshot
+that flytrap import restores into another flytrap.
+It reads the disk store in --data-dir, or asks a running flytrap with --url http://localhost:9001.`,
+	Args: cobra.NoArgs,
+	// Execute reports the error
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := url.Values{}
+		for name, value := range exportFilter {
+			if *value != "" {
+				filter.Set(name, *value)
+			}
+		}
+		var w io.Writer = os.Stdout
+		if exportOutput != "" && exportOutput != "-" {
+			f, err := os.Create(exportOutput)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return internal.Export(internal.ExportOptions{
+			Format:  exportFormat,
+			URL:     exportURL,
+			DataDir: dataDir,
+			Filter:  filter,
+		}, w)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVar(&exportFormat, "format", internal.ExportHAR, "export format: har, or jsonl for a snapshot flytrap import restores")
+	exportCmd.Flags().StringVar(&exportURL, "url", "", "query server of a running flytrap to export from, eg: http://localhost:9001 (the disk store in --data-dir is read otherwise)")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write to (stdout by default)")
+	for name, usage := range map[string]string{
+		"path":   "only requests captured on this path",
+		"prefix": "only requests on paths under this prefix",
+		"method": "only requests with this method",
+		"bin":    "only requests captured in this bin",
+		"since":  "only requests received after this RFC3339 time",
+		"until":  "only requests received before this RFC3339 time",
+	} {
+		exportFilter[name] = exportCmd.Flags().String(name, "", usage)
+	}
+}
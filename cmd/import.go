@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/urjitbhatia/http-flytrap/internal"
+)
+
+var importURL string
+var importReplace bool
+
+// importCmd restores a snapshot written by export --format jsonl, into a running flytrap or the disk store
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Restore a snapshot of captured requests",
+	Long: `Import restores a snapshot written by flytrap export --format jsonl, reading stdin when no file is given.
+It sends the snapshot to a running flytrap with --url http://localhost:9001, otherwise it writes it
+into the disk store in --data-dir, which flytrap must not be running on, without the responses, faults and proxies.
+Requests that are already stored are skipped, --replace drops the requests and bins stored before.`,
+	Args: cobra.MaximumNArgs(1),
+	// Execute reports the error
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var r io.Reader = os.Stdin
+		if len(args) == 1 && args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		res, err := internal.Import(internal.ImportOptions{
+			URL:     importURL,
+			DataDir: dataDir,
+			Replace: importReplace,
+		}, r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d requests, %d bins and %d rules, skipped %d requests already stored\n",
+			res.Requests, res.Bins, res.Rules, res.Skipped)
+		if res.SkippedRules > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d responses, faults and proxies, the disk store doesn't keep them (use --url)\n", res.SkippedRules)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().StringVar(&importURL, "url", "", "query server of a running flytrap to import into, eg: http://localhost:9001 (the disk store in --data-dir is written otherwise)")
+	importCmd.Flags().BoolVar(&importReplace, "replace", false, "drop everything stored before importing")
+}
@@ -13,6 +13,19 @@ import (
 var capturePort = "9000"
 var queryPort = "9001"
 var ttl time.Duration
+var expiry string
+var responsesFile string
+var proxies []string
+var grpcDescriptors []string
+var echo bool
+var store string
+var dataDir string
+var limits internal.RetentionLimits
+var tlsCapturePort string
+var tlsCert string
+var tlsKey string
+var tlsClientAuth string
+var tlsClientCA string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -21,11 +34,29 @@ var rootCmd = &cobra.Command{
 	Long: `Flytrap captures http requests that are sent to it and stores for a some time.
 You can ask flytrap what requests it has captured so far, however its stickiness decays over time.
 Any path that hasn't seen a request for more than a TTL duration, will forget the requests it saw previously.
-(This TTL can be configured)`,
+(This TTL can be configured, and can also be applied to each request individually with --expiry request)`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
-		internal.Trap(capturePort, queryPort, ttl)
+		internal.Trap(internal.Config{
+			CapturePort:     capturePort,
+			QueryPort:       queryPort,
+			TTL:             ttl,
+			Expiry:          expiry,
+			ResponsesFile:   responsesFile,
+			Proxies:         proxies,
+			GRPCDescriptors: grpcDescriptors,
+			Echo:            echo,
+			Store:           store,
+			DataDir:         dataDir,
+			Limits:          limits,
+
+			TLSCapturePort: tlsCapturePort,
+			TLSCert:        tlsCert,
+			TLSKey:         tlsKey,
+			TLSClientAuth:  tlsClientAuth,
+			TLSClientCA:    tlsClientCA,
+		})
 	},
 }
 
@@ -40,6 +71,21 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&capturePort, "capturePort", "c", "9000", "capture port - all requests to this endpoint are captured")
+	rootCmd.PersistentFlags().StringVar(&tlsCapturePort, "tls-capture-port", "", "also capture requests over https on this port")
+	rootCmd.PersistentFlags().StringVar(&tlsCert, "tls-cert", "", "certificate file for the tls capture port, a self-signed CA and certificates are generated if not given")
+	rootCmd.PersistentFlags().StringVar(&tlsKey, "tls-key", "", "private key file for --tls-cert")
+	rootCmd.PersistentFlags().StringVar(&tlsClientAuth, "tls-client-auth", internal.ClientAuthNone, "ask clients of the tls capture port for certificates: none, request or require")
+	rootCmd.PersistentFlags().StringVar(&tlsClientCA, "tls-client-ca", "", "CA bundle to verify client certificates against, in require mode unverified clients are refused")
 	rootCmd.PersistentFlags().StringVarP(&queryPort, "queryPort", "q", "9001", "query interface port")
-	rootCmd.PersistentFlags().DurationVarP(&ttl, "ttl", "t", time.Minute*30, "Time to remember captured requests (use go time.duration format. Eg: 10m)")
+	rootCmd.PersistentFlags().DurationVarP(&ttl, "ttl", "t", internal.HandlerTTLFromEnv(), "Time to remember captured requests, defaults to the HANDLER_TTL env var if set (use go time.duration format. Eg: 10m)")
+	rootCmd.PersistentFlags().StringVar(&expiry, "expiry", internal.ExpiryPath, "how the ttl applies: path (a path forgets everything once inactive for the ttl) or request (each request is forgotten once older than the ttl)")
+	rootCmd.PersistentFlags().StringVarP(&responsesFile, "responses", "r", "", "json file with mock responses to reply with on capture paths")
+	rootCmd.PersistentFlags().StringArrayVar(&proxies, "proxy", nil, "forward captured requests and record the upstream response: an upstream url for all paths or /prefix=url (repeatable)")
+	rootCmd.PersistentFlags().BoolVar(&echo, "echo", false, "reply to captured requests with a json description of the request, unless the path has a response or upstream")
+	rootCmd.PersistentFlags().StringArrayVar(&grpcDescriptors, "grpc-descriptors", nil, "FileDescriptorSet file (protoc --descriptor_set_out) to decode captured grpc messages with (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&store, "store", internal.StoreMemory, "where captured requests are kept: memory or disk (survives restarts)")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", internal.DefaultDataDir, "directory for the disk store and the generated tls CA")
+	rootCmd.PersistentFlags().IntVar(&limits.MaxRequestsPerPath, "max-requests-per-path", 0, "keep at most this many requests per path, dropping the oldest (0 for no limit)")
+	rootCmd.PersistentFlags().Int64Var(&limits.MaxTotalBytes, "max-total-bytes", 0, "keep at most this many bytes of captured requests, dropping the oldest across all paths (0 for no limit)")
+	rootCmd.PersistentFlags().Int64Var(&limits.MaxBodyBytes, "max-body-bytes", 0, "truncate captured bodies to this many bytes (0 for no limit)")
 }
@@ -0,0 +1,14 @@
+module github.com/urjitbhatia/http-flytrap
+
+go 1.24
+
+require (
+	github.com/google/uuid v1.1.1
+	github.com/spf13/cobra v1.8.1
+	google.golang.org/protobuf v1.36.12
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+)
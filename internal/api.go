@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Body encodings reported by the api
+const (
+	bodyEncodingUTF8   = "utf8"
+	bodyEncodingBase64 = "base64"
+)
+
+type apiPath struct {
+	Path     string `json:"path"`
+	Requests int    `json:"requests"`
+}
+
+type apiRequest struct {
+	ID            string        `json:"id"`
+	Path          string        `json:"path"`
+	Method        string        `json:"method"`
+	Proto         string        `json:"proto"`
+	Host          string        `json:"host"`
+	URL           string        `json:"url"`
+	Query         url.Values    `json:"query"`
+	Headers       http.Header   `json:"headers"`
+	Trailers      http.Header   `json:"trailers,omitempty"`
+	Body          string        `json:"body"`
+	BodyEncoding  string        `json:"bodyEncoding"`
+	BodyTruncated bool          `json:"bodyTruncated,omitempty"`
+	BodySize      int64         `json:"bodySize"`
+	ContentLength int64         `json:"contentLength"`
+	RemoteAddr    string        `json:"remoteAddr"`
+	StreamID      uint32        `json:"streamID,omitempty"`
+	TLS           *TLSInfo      `json:"tls,omitempty"`
+	ReceivedAt    time.Time     `json:"receivedAt"`
+	Response      *apiResponse  `json:"response,omitempty"`
+	Upstream      *apiUpstream  `json:"upstream,omitempty"`
+	WebSocket     *apiWebSocket `json:"websocket,omitempty"`
+	GRPC          *GRPCCall     `json:"grpc,omitempty"`
+	Fault         *apiFault     `json:"fault,omitempty"`
+}
+
+type apiResponse struct {
+	Status         int         `json:"status"`
+	Proto          string      `json:"proto"`
+	Headers        http.Header `json:"headers"`
+	Trailers       http.Header `json:"trailers,omitempty"`
+	Body           string      `json:"body"`
+	BodyEncoding   string      `json:"bodyEncoding"`
+	BodyTruncated  bool        `json:"bodyTruncated,omitempty"`
+	BodySize       int64       `json:"bodySize"`
+	Latency        string      `json:"latency,omitempty"`
+	Disconnected   bool        `json:"disconnected,omitempty"`
+	DisconnectedAt *time.Time  `json:"disconnectedAt,omitempty"`
+	Delivered      int         `json:"delivered,omitempty"`
+}
+
+type apiUpstream struct {
+	URL      string       `json:"url"`
+	Response *apiResponse `json:"response,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Duration string       `json:"duration"`
+}
+
+type apiWebSocket struct {
+	Subprotocol   string              `json:"subprotocol,omitempty"`
+	Frames        []apiWebSocketFrame `json:"frames"`
+	FramesDropped int                 `json:"framesDropped,omitempty"`
+	ClosedAt      *time.Time          `json:"closedAt,omitempty"`
+}
+
+type apiWebSocketFrame struct {
+	Direction       string    `json:"direction"`
+	Type            string    `json:"type"`
+	Fin             bool      `json:"fin"`
+	Payload         string    `json:"payload,omitempty"`
+	PayloadEncoding string    `json:"payloadEncoding,omitempty"`
+	Truncated       bool      `json:"truncated,omitempty"`
+	CloseCode       int       `json:"closeCode,omitempty"`
+	CloseReason     string    `json:"closeReason,omitempty"`
+	At              time.Time `json:"at"`
+}
+
+type apiFault struct {
+	Latency    string `json:"latency,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	Connection string `json:"connection,omitempty"`
+	Drip       bool   `json:"drip,omitempty"`
+}
+
+type apiStats struct {
+	Paths     int             `json:"paths"`
+	Requests  int             `json:"requests"`
+	Retention *retentionStats `json:"retention,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// newAPIRequest converts a captured request into its api representation
+func newAPIRequest(path string, cr *CapturedRequest) apiRequest {
+	u := cr.URL()
+	ar := apiRequest{
+		ID:            cr.ID,
+		Path:          path,
+		Method:        cr.Method,
+		Proto:         cr.Proto,
+		Host:          cr.Host,
+		URL:           u.String(),
+		Query:         u.Query(),
+		Headers:       cr.Header,
+		Trailers:      cr.Trailer,
+		BodyTruncated: cr.BodyTruncated,
+		BodySize:      cr.BodySize,
+		ContentLength: cr.ContentLength,
+		RemoteAddr:    cr.RemoteAddr,
+		StreamID:      cr.StreamID,
+		TLS:           cr.TLS,
+		ReceivedAt:    cr.ReceivedAt,
+		GRPC:          cr.GRPC,
+	}
+	ar.Body, ar.BodyEncoding = encodeBody(cr.Body)
+	ar.Response = newAPIResponse(cr.Response)
+	if up := cr.Upstream; up != nil {
+		ar.Upstream = &apiUpstream{
+			URL:      up.URL,
+			Response: newAPIResponse(up.Response),
+			Error:    up.Error,
+			Duration: up.Duration.String(),
+		}
+	}
+	if f := cr.Fault; f != nil {
+		ar.Fault = &apiFault{Status: f.Status, Connection: f.Connection, Drip: f.Drip}
+		if f.Latency > 0 {
+			ar.Fault.Latency = f.Latency.String()
+		}
+	}
+	if ws := cr.WebSocket; ws != nil {
+		ar.WebSocket = &apiWebSocket{Subprotocol: ws.Subprotocol, FramesDropped: ws.FramesDropped, ClosedAt: ws.ClosedAt}
+		ar.WebSocket.Frames = make([]apiWebSocketFrame, 0, len(ws.Frames))
+		for _, f := range ws.Frames {
+			af := apiWebSocketFrame{
+				Direction:   f.Direction,
+				Type:        f.Type,
+				Fin:         f.Fin,
+				Truncated:   f.Truncated,
+				CloseCode:   f.CloseCode,
+				CloseReason: f.CloseReason,
+				At:          f.At,
+			}
+			if len(f.Payload) > 0 {
+				af.Payload, af.PayloadEncoding = encodeBody(f.Payload)
+			}
+			ar.WebSocket.Frames = append(ar.WebSocket.Frames, af)
+		}
+	}
+	return ar
+}
+
+func newAPIResponse(cr *CapturedResponse) *apiResponse {
+	if cr == nil {
+		return nil
+	}
+	ar := &apiResponse{
+		Status:         cr.Status,
+		Proto:          cr.Proto,
+		Headers:        cr.Header,
+		Trailers:       cr.Trailer,
+		BodyTruncated:  cr.BodyTruncated,
+		BodySize:       cr.BodySize,
+		Disconnected:   cr.Disconnected,
+		DisconnectedAt: cr.DisconnectedAt,
+		Delivered:      cr.Delivered,
+	}
+	if cr.Latency > 0 {
+		ar.Latency = cr.Latency.String()
+	}
+	ar.Body, ar.BodyEncoding = encodeBody(cr.Body)
+	return ar
+}
+
+// encodeBody returns the body as text if it is valid utf8 and as base64 otherwise
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), bodyEncodingUTF8
+	}
+	return base64.StdEncoding.EncodeToString(body), bodyEncodingBase64
+}
+
+// toAPIRequests converts the requests stored for a path
+func toAPIRequests(path string, values []*CapturedRequest) []apiRequest {
+	reqs := make([]apiRequest, 0, len(values))
+	for _, v := range values {
+		reqs = append(reqs, newAPIRequest(path, v))
+	}
+	return reqs
+}
+
+// sortAPIRequests orders requests by the time they were received, oldest first
+func sortAPIRequests(reqs []apiRequest) {
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].ReceivedAt.Before(reqs[j].ReceivedAt) })
+}
+
+// findRequest returns the stored request with the id and the path it was captured on, or nil
+func findRequest(store storage, id string) (string, *CapturedRequest) {
+	var path string
+	var found *CapturedRequest
+	store.foreach(func(key string, values []*CapturedRequest) bool {
+		for _, v := range values {
+			if v.ID == id {
+				path, found = key, v
+				return false
+			}
+		}
+		return true
+	})
+	return path, found
+}
+
+// createAPIHandler serves the versioned json api over the captured requests
+func createAPIHandler(env *captureEnv) http.Handler {
+	mux := http.NewServeMux()
+	store := env.store
+
+	mux.HandleFunc("GET /api/v1/paths", func(w http.ResponseWriter, r *http.Request) {
+		paths := []apiPath{}
+		store.foreach(func(key string, values []*CapturedRequest) bool {
+			paths = append(paths, apiPath{Path: key, Requests: len(values)})
+			return true
+		})
+		sort.Slice(paths, func(i, j int) bool { return paths[i].Path < paths[j].Path })
+		writeJSON(w, http.StatusOK, paths)
+	})
+
+	// the captured path is a query param, eg: /api/v1/requests?path=/hooks/x, so / and nested paths can be asked for
+	mux.HandleFunc("GET /api/v1/requests", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if !strings.HasPrefix(path, "/") {
+			writeError(w, http.StatusBadRequest, "path must start with /: "+path)
+			return
+		}
+		if !store.exists(path) {
+			writeError(w, http.StatusNotFound, "no requests captured for path: "+path)
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIRequests(path, store.load(path)))
+	})
+
+	mux.HandleFunc("GET /api/v1/requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		path, cr := findRequest(store, id)
+		if cr == nil {
+			writeError(w, http.StatusNotFound, "no request with id: "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, newAPIRequest(path, cr))
+	})
+	registerSnippetAPI(mux, store)
+
+	mux.HandleFunc("GET /api/v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := apiStats{}
+		store.foreach(func(key string, values []*CapturedRequest) bool {
+			stats.Paths++
+			stats.Requests += len(values)
+			return true
+		})
+		if bs, ok := store.(*boundedStore); ok {
+			rs := bs.retentionStats()
+			stats.Retention = &rs
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	// long poll until matching requests are captured, see waitHandler for the supported params
+	mux.HandleFunc("GET /api/v1/wait", waitHandler(store, env.notifier))
+
+	// live tail of captures, filtered like wait
+	mux.HandleFunc("GET /api/v1/stream", sseHandler(env.broker))
+	mux.HandleFunc("GET /api/v1/ws", wsStreamHandler(env.broker))
+
+	registerResponseAPI(mux, env.responses)
+	registerSequenceAPI(mux, env.responses)
+	registerBinAPI(mux, env, &pathmap)
+	registerProxyAPI(mux, env.proxies)
+	registerFaultAPI(mux, env.faults)
+	registerTLSAPI(mux, env)
+	registerExportAPI(mux, store)
+	registerSnapshotAPI(mux, env, &pathmap)
+
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "unknown api endpoint: "+r.URL.Path)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error writing api response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// apiServer serves the api the way the query server does, under its own mux
+func apiServer(t *testing.T, env *captureEnv) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", createAPIHandler(env))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getJSON(t *testing.T, u string, v interface{}) int {
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPIRequestsOnPath(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	env.store.append("/", testRequest("root"))
+	env.store.append("/hooks/x", testRequest("nested"))
+	srv := apiServer(t, env)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		id     string
+	}{
+		{"/", http.StatusOK, "root"},
+		{"/hooks/x", http.StatusOK, "nested"},
+		{"/hooks", http.StatusNotFound, ""},
+		{"hooks/x", http.StatusBadRequest, ""},
+	} {
+		var reqs []apiRequest
+		status := getJSON(t, srv.URL+"/api/v1/requests?"+url.Values{"path": {tc.path}}.Encode(), &reqs)
+		if status != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, status, tc.status)
+			continue
+		}
+		if tc.id != "" && (len(reqs) != 1 || reqs[0].ID != tc.id || reqs[0].Path != tc.path) {
+			t.Errorf("%s: got %+v, want request %s", tc.path, reqs, tc.id)
+		}
+	}
+
+	var paths []apiPath
+	if getJSON(t, srv.URL+"/api/v1/paths", &paths); len(paths) != 2 || paths[0].Path != "/" || paths[1].Path != "/hooks/x" {
+		t.Errorf("got paths %+v, want / and /hooks/x", paths)
+	}
+}
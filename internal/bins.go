@@ -0,0 +1,431 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// binPrefix is where bins live on the capture port, requests to /b/{id}/... are captured into bin {id}
+const binPrefix = "/b/"
+
+// bin is an isolated set of capture paths, so teams sharing a flytrap don't step on each other
+type bin struct {
+	ID        string        `json:"id"`
+	Owner     string        `json:"owner,omitempty"`
+	TTL       time.Duration `json:"ttl,omitempty"` // overrides the flytrap TTL for the paths in the bin
+	CreatedAt time.Time     `json:"createdAt"`
+
+	lastActive  time.Time
+	savedActive time.Time // the lastActive last written to the bins file
+}
+
+// savedBin is a bin as it is kept in the bins file
+type savedBin struct {
+	bin
+	LastActive time.Time `json:"lastActive,omitempty"`
+}
+
+// prefix is the capture path prefix of the bin
+func (b *bin) prefix() string {
+	return binPrefix + b.ID + "/"
+}
+
+type apiBin struct {
+	*bin
+	TTL           string    `json:"ttl,omitempty"`
+	CaptureURL    string    `json:"captureURL"`
+	TLSCaptureURL string    `json:"tlsCaptureURL,omitempty"` // set when the tls capture port is on
+	LastActive    time.Time `json:"lastActive"`
+	Paths         []apiPath `json:"paths"`
+}
+
+// binsFile is where bins are saved with the disk store, next to its segments
+const binsFile = "bins.json"
+
+// binActiveSaveInterval is how stale the activity of a bin in the bins file may get,
+// saving it on every captured request would write the file over and over
+const binActiveSaveInterval = time.Minute
+
+type binRegistry struct {
+	mu   sync.Mutex
+	bins map[string]*bin
+	file string // the bins are saved here on every change, when set
+
+	// storing is held for reading while a request is stored in a bin and for writing while a bin is removed,
+	// so a request captured as its bin is deleted is either deleted with it or not stored at all
+	storing sync.RWMutex
+}
+
+func newBinRegistry() *binRegistry {
+	return &binRegistry{bins: make(map[string]*bin)}
+}
+
+// openBinRegistry loads the bins saved in file and keeps saving them there, the file is created when needed.
+// Bins saved without their last activity count as active from now on.
+func openBinRegistry(file string) (*binRegistry, error) {
+	br := &binRegistry{bins: make(map[string]*bin), file: file}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return br, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []savedBin
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("reading bins from %s: %v", file, err)
+	}
+	now := time.Now()
+	for _, sb := range saved {
+		b := sb.bin
+		b.lastActive, b.savedActive = sb.LastActive, sb.LastActive
+		if b.lastActive.IsZero() {
+			b.lastActive = now
+		}
+		br.bins[b.ID] = &b
+	}
+	return br, nil
+}
+
+// save writes the bins to the file, replacing it only once they are all written. Callers must hold br.mu.
+func (br *binRegistry) save() {
+	if br.file == "" {
+		return
+	}
+	saved := []savedBin{}
+	for _, b := range br.sorted() {
+		saved = append(saved, savedBin{bin: b, LastActive: b.lastActive})
+		br.bins[b.ID].savedActive = b.lastActive
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = os.WriteFile(br.file+".tmp", data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(br.file+".tmp", br.file)
+	}
+	if err != nil {
+		log.Printf("Error saving bins to %s: %v", br.file, err)
+	}
+}
+
+// binID returns the id of the bin a capture path belongs to, if it belongs to one
+func binID(path string) (string, bool) {
+	if !strings.HasPrefix(path, binPrefix) {
+		return "", false
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(path, binPrefix), "/")
+	return id, id != ""
+}
+
+func (br *binRegistry) create(owner string, ttl time.Duration) *bin {
+	now := time.Now()
+	b := &bin{ID: uuid.New().String(), Owner: owner, TTL: ttl, CreatedAt: now, lastActive: now}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.bins[b.ID] = b
+	br.save()
+	return b
+}
+
+// restore adds a bin from a snapshot, keeping its id, it returns false if the bin already exists
+func (br *binRegistry) restore(b bin) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if _, ok := br.bins[b.ID]; ok {
+		return false
+	}
+	b.lastActive = time.Now()
+	br.bins[b.ID] = &b
+	br.save()
+	return true
+}
+
+func (br *binRegistry) get(id string) (bin, bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	b, ok := br.bins[id]
+	if !ok {
+		return bin{}, false
+	}
+	return *b, true
+}
+
+// touch marks a bin as active, it returns false if there is no such bin
+func (br *binRegistry) touch(id string) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	b, ok := br.bins[id]
+	if ok {
+		b.lastActive = time.Now()
+		if b.lastActive.Sub(b.savedActive) >= binActiveSaveInterval {
+			br.save()
+		}
+	}
+	return ok
+}
+
+// whileExists runs store if the bin that path is in still exists, or if path is not in a bin, and returns whether it ran.
+// Removing the bin waits for it to finish.
+func (br *binRegistry) whileExists(path string, store func()) bool {
+	id, ok := binID(path)
+	if !ok {
+		store()
+		return true
+	}
+	br.storing.RLock()
+	defer br.storing.RUnlock()
+	br.mu.Lock()
+	_, ok = br.bins[id]
+	br.mu.Unlock()
+	if ok {
+		store()
+	}
+	return ok
+}
+
+func (br *binRegistry) remove(id string) bool {
+	br.storing.Lock()
+	defer br.storing.Unlock()
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	_, ok := br.bins[id]
+	delete(br.bins, id)
+	if ok {
+		br.save()
+	}
+	return ok
+}
+
+func (br *binRegistry) list() []bin {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	return br.sorted()
+}
+
+// sorted copies the bins, oldest first. Callers must hold br.mu.
+func (br *binRegistry) sorted() []bin {
+	all := make([]bin, 0, len(br.bins))
+	for _, b := range br.bins {
+		all = append(all, *b)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.Before(all[j].CreatedAt) })
+	return all
+}
+
+// ttlFor returns the TTL for a capture path, the bin TTL if the path is in a bin that has one
+func (br *binRegistry) ttlFor(path string, ttl time.Duration) time.Duration {
+	id, ok := binID(path)
+	if !ok {
+		return ttl
+	}
+	if b, ok := br.get(id); ok && b.TTL > 0 {
+		return b.TTL
+	}
+	return ttl
+}
+
+// expired returns the bins that have been inactive for longer than their TTL
+func (br *binRegistry) expired(ttl time.Duration) []string {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	ids := []string{}
+	for id, b := range br.bins {
+		binTTL := ttl
+		if b.TTL > 0 {
+			binTTL = b.TTL
+		}
+		if time.Since(b.lastActive) >= binTTL {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// deleteBin removes a bin with all its captured requests, handlers and responses
+func (e *captureEnv) deleteBin(id string, handlers *sync.Map) bool {
+	if !e.bins.remove(id) {
+		return false
+	}
+	prefix := binPrefix + id + "/"
+	handlers.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			handlers.Delete(key)
+		}
+		return true
+	})
+	e.store.foreach(func(key string, values []*CapturedRequest) bool {
+		if strings.HasPrefix(key, prefix) {
+			e.store.delete(key)
+		}
+		return true
+	})
+	e.responses.removePrefix(prefix)
+	e.faults.removePrefix(prefix)
+	e.proxies.removePrefix(prefix)
+	return true
+}
+
+// pruneBins deletes the bins that have been inactive for longer than their TTL
+func pruneBins(ttl time.Duration, env *captureEnv, handlers *sync.Map) {
+	for _, id := range env.bins.expired(ttl) {
+		log.Printf("Pruning inactive bin: %s", id)
+		env.deleteBin(id, handlers)
+	}
+}
+
+// captureURL builds the url clients should send requests for the bin to.
+// The host is taken from the query request since that is how the user reached flytrap.
+func captureURL(r *http.Request, scheme, capturePort string, b *bin) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	return scheme + "://" + net.JoinHostPort(host, capturePort) + b.prefix()
+}
+
+func binPaths(store storage, b *bin) []apiPath {
+	paths := []apiPath{}
+	store.foreach(func(key string, values []*CapturedRequest) bool {
+		if strings.HasPrefix(key, b.prefix()) {
+			paths = append(paths, apiPath{Path: key, Requests: len(values)})
+		}
+		return true
+	})
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Path < paths[j].Path })
+	return paths
+}
+
+func newAPIBin(r *http.Request, env *captureEnv, b bin) apiBin {
+	ab := apiBin{
+		bin:        &b,
+		CaptureURL: captureURL(r, "http", env.capturePort, &b),
+		LastActive: b.lastActive,
+		Paths:      binPaths(env.store, &b),
+	}
+	if env.tlsCapturePort != "" {
+		ab.TLSCaptureURL = captureURL(r, "https", env.tlsCapturePort, &b)
+	}
+	if b.TTL > 0 {
+		ab.TTL = b.TTL.String()
+	}
+	return ab
+}
+
+type apiNewBin struct {
+	Owner string `json:"owner"`
+	TTL   string `json:"ttl"`
+}
+
+// registerBinAPI adds the endpoints to create, inspect and delete bins
+func registerBinAPI(mux *http.ServeMux, env *captureEnv, handlers *sync.Map) {
+	mux.HandleFunc("POST /api/v1/bins", func(w http.ResponseWriter, r *http.Request) {
+		req := apiNewBin{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid bin: "+err.Error())
+				return
+			}
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid ttl: "+req.TTL+" (use go time.duration format. Eg: 10m)")
+				return
+			}
+		}
+		b := env.bins.create(req.Owner, ttl)
+		log.Printf("Created bin: %s owner: %s", b.ID, b.Owner)
+		writeJSON(w, http.StatusCreated, newAPIBin(r, env, *b))
+	})
+
+	mux.HandleFunc("GET /api/v1/bins", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.URL.Query().Get("owner")
+		bins := []apiBin{}
+		for _, b := range env.bins.list() {
+			if owner == "" || b.Owner == owner {
+				bins = append(bins, newAPIBin(r, env, b))
+			}
+		}
+		writeJSON(w, http.StatusOK, bins)
+	})
+
+	// lookupBin writes a 404 and returns false if the bin in the request path doesn't exist
+	lookupBin := func(w http.ResponseWriter, r *http.Request) (bin, bool) {
+		b, ok := env.bins.get(r.PathValue("id"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "no bin with id: "+r.PathValue("id"))
+		}
+		return b, ok
+	}
+
+	mux.HandleFunc("GET /api/v1/bins/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if b, ok := lookupBin(w, r); ok {
+			writeJSON(w, http.StatusOK, newAPIBin(r, env, b))
+		}
+	})
+
+	mux.HandleFunc("GET /api/v1/bins/{id}/requests", func(w http.ResponseWriter, r *http.Request) {
+		b, ok := lookupBin(w, r)
+		if !ok {
+			return
+		}
+		reqs := []apiRequest{}
+		for _, p := range binPaths(env.store, &b) {
+			reqs = append(reqs, toAPIRequests(p.Path, env.store.load(p.Path))...)
+		}
+		sortAPIRequests(reqs)
+		writeJSON(w, http.StatusOK, reqs)
+	})
+
+	mux.HandleFunc("DELETE /api/v1/bins/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := lookupBin(w, r); ok {
+			env.deleteBin(r.PathValue("id"), handlers)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	// bin responses take paths relative to the bin, eg: /hooks or /* for every path in the bin
+	mux.HandleFunc("GET /api/v1/bins/{id}/responses", func(w http.ResponseWriter, r *http.Request) {
+		b, ok := lookupBin(w, r)
+		if !ok {
+			return
+		}
+		mrs := []*mockResponse{}
+		for _, mr := range env.responses.list() {
+			if strings.HasPrefix(mr.Path, b.prefix()) {
+				mrs = append(mrs, mr)
+			}
+		}
+		writeJSON(w, http.StatusOK, mrs)
+	})
+
+	mux.HandleFunc("PUT /api/v1/bins/{id}/responses", func(w http.ResponseWriter, r *http.Request) {
+		b, ok := lookupBin(w, r)
+		if !ok {
+			return
+		}
+		mr := &mockResponse{}
+		if err := json.NewDecoder(r.Body).Decode(mr); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid response: "+err.Error())
+			return
+		}
+		mr.Path = strings.TrimSuffix(b.prefix(), "/") + "/" + strings.TrimPrefix(mr.Path, "/")
+		if err := env.responses.set(mr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, mr)
+	})
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// foreachHook calls after once a walk over the store is done
+type foreachHook struct {
+	storage
+	after func()
+}
+
+func (s foreachHook) foreach(f func(key string, values []*CapturedRequest) bool) {
+	s.storage.foreach(f)
+	s.after()
+}
+
+func TestDeleteBinDuringCapture(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	b := env.bins.create("", 0)
+	path := b.prefix() + "hooks"
+	store := blockingStore{storage: env.store, key: path, entered: make(chan struct{}), release: make(chan struct{})}
+	// the stuck capture goes on once the delete has looked for the requests of the bin,
+	// or after a while if the delete is waiting for it
+	var once sync.Once
+	release := func() { once.Do(func() { close(store.release) }) }
+	env.store = foreachHook{storage: store, after: release}
+
+	captured := make(chan struct{})
+	go func() {
+		defer close(captured)
+		env.capture(path, testRequest("late"))
+	}()
+	<-store.entered
+	deleted := make(chan struct{})
+	go func() {
+		defer close(deleted)
+		env.deleteBin(b.ID, &sync.Map{})
+	}()
+	select {
+	case <-deleted:
+	case <-time.After(50 * time.Millisecond):
+		release()
+	}
+	<-captured
+	<-deleted
+
+	if env.store.exists(path) {
+		t.Error("a request captured while its bin was deleted outlived the bin")
+	}
+	// once the bin is gone nothing is stored for it
+	env.capture(path, testRequest("after"))
+	if env.store.exists(path) {
+		t.Error("a request was stored in a deleted bin")
+	}
+}
+
+func TestBinLastActiveSaved(t *testing.T) {
+	file := filepath.Join(t.TempDir(), binsFile)
+	br, err := openBinRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := br.create("team-a", time.Hour)
+	idle := time.Now().Add(-2 * time.Hour).Round(0)
+	br.mu.Lock()
+	br.bins[b.ID].lastActive = idle
+	br.save()
+	br.mu.Unlock()
+
+	reopened, err := openBinRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.get(b.ID); !got.lastActive.Equal(idle) {
+		t.Errorf("got last activity %v, want %v", got.lastActive, idle)
+	}
+	// a restart doesn't keep an idle bin alive
+	if expired := reopened.expired(24 * time.Hour); len(expired) != 1 || expired[0] != b.ID {
+		t.Errorf("got expired bins %v, want %s", expired, b.ID)
+	}
+}
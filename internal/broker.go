@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many captures a slow subscriber can fall behind before events are dropped
+const subscriberBuffer = 64
+
+// streamKeepAlive is how often an idle stream is pinged so proxies don't close it
+const streamKeepAlive = time.Second * 15
+
+// Kinds of capture events, a request is published when it arrives and again once it has been replied to.
+// Requests that opened a websocket are also published for every frame until it closes.
+const (
+	eventRequest   = "request"
+	eventResponse  = "response"
+	eventWebSocket = "websocket"
+)
+
+type captureEvent struct {
+	kind    string
+	path    string
+	request *CapturedRequest
+}
+
+// wsStreamMessage is a capture event sent over the websocket stream, the kind is what SSE puts in the event field
+type wsStreamMessage struct {
+	Event string     `json:"event"`
+	Data  apiRequest `json:"data"`
+}
+
+type subscription struct {
+	events  chan captureEvent
+	filter  requestMatcher
+	dropped int
+}
+
+// broker fans captured requests out to live subscribers.
+// Publishing never blocks the capture handler, events for a subscriber that is not keeping up are dropped.
+type broker struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[*subscription]struct{})}
+}
+
+func (b *broker) subscribe(filter requestMatcher) *subscription {
+	s := &subscription{events: make(chan captureEvent, subscriberBuffer), filter: filter}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *broker) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		if s.dropped > 0 {
+			log.Printf("Stream subscriber dropped %d events", s.dropped)
+		}
+	}
+}
+
+func (b *broker) publish(kind, path string, cr *CapturedRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if !s.filter.matches(path, cr) {
+			continue
+		}
+		select {
+		case s.events <- captureEvent{kind: kind, path: path, request: cr}:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// sseHandler streams captured requests as server sent events.
+// A request event is sent when a request arrives and a response event, with the same data plus the response,
+// once it has been replied to. It accepts the same filters as the wait api, plus prefix to match a path prefix.
+func sseHandler(b *broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := newRequestMatcher(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rc := http.NewResponseController(w)
+		sub := b.subscribe(filter)
+		defer b.unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			log.Printf("Stream does not support flushing: %v", err)
+			return
+		}
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case ev := <-sub.events:
+				data, err := json.Marshal(newAPIRequest(ev.path, ev.request))
+				if err != nil {
+					log.Printf("Error encoding stream event: %v", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", ev.kind, ev.request.ID, data)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsStreamHandler streams captured requests as json text messages over a websocket, each wrapped with its event kind,
+// with the same filters as sseHandler. A request is sent when it arrives and again, with its response, once it
+// has been replied to. Anything the client sends other than a close is ignored.
+func wsStreamHandler(b *broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := newRequestMatcher(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		conn, err := upgradeWebsocket(w, r, "")
+		if err != nil {
+			log.Printf("Stream websocket upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		sub := b.subscribe(filter)
+		defer b.unsubscribe(sub)
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				f, err := conn.readFrame()
+				if err != nil {
+					return
+				}
+				switch f.opcode {
+				case wsPing:
+					conn.writeFrame(wsPong, f.payload)
+				case wsClose:
+					code, _ := parseWSClose(f.payload)
+					if code == wsCloseNoStatus {
+						// 1005 only reports an empty close frame, it must not be sent
+						code = wsCloseNormal
+					}
+					conn.writeClose(code, "")
+					return
+				}
+			}
+		}()
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case ev := <-sub.events:
+				data, err := json.Marshal(wsStreamMessage{Event: ev.kind, Data: newAPIRequest(ev.path, ev.request)})
+				if err != nil {
+					log.Printf("Error encoding stream event: %v", err)
+					continue
+				}
+				if err := conn.writeFrame(wsText, data); err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if err := conn.writeFrame(wsPing, nil); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CapturedRequest is a request received on the capture port, as it was seen on the wire
+type CapturedRequest struct {
+	ID               string      `json:"id"`
+	Method           string      `json:"method"`
+	Proto            string      `json:"proto"`
+	Host             string      `json:"host"`
+	Path             string      `json:"path"`
+	RawQuery         string      `json:"rawQuery"`
+	Header           http.Header `json:"header"`
+	Trailer          http.Header `json:"trailer,omitempty"`
+	TransferEncoding []string    `json:"transferEncoding,omitempty"`
+	Body             []byte      `json:"body"`
+	BodyTruncated    bool        `json:"bodyTruncated,omitempty"` // only the first part of the body was kept
+	BodySize         int64       `json:"bodySize"`                // size of the body that was received
+	ContentLength    int64       `json:"contentLength"`
+	RemoteAddr       string      `json:"remoteAddr"`
+	StreamID         uint32      `json:"streamID,omitempty"` // the HTTP/2 stream the request arrived on
+	TLS              *TLSInfo    `json:"tls,omitempty"`
+	ReceivedAt       time.Time   `json:"receivedAt"`
+
+	Response  *CapturedResponse `json:"response,omitempty"`  // what flytrap replied, once it is done replying
+	Upstream  *UpstreamExchange `json:"upstream,omitempty"`  // set when the request was forwarded
+	WebSocket *WebSocketSession `json:"websocket,omitempty"` // set when the request opened a websocket
+	GRPC      *GRPCCall         `json:"grpc,omitempty"`      // set for grpc calls
+	Fault     *InjectedFault    `json:"fault,omitempty"`     // set when a fault rule matched the request
+}
+
+// CapturedResponse is a response that was sent back for a captured request
+type CapturedResponse struct {
+	Status         int           `json:"status"`
+	Proto          string        `json:"proto"`
+	Header         http.Header   `json:"header"`
+	Trailer        http.Header   `json:"trailer,omitempty"`
+	Body           []byte        `json:"body"`
+	BodyTruncated  bool          `json:"bodyTruncated,omitempty"`
+	BodySize       int64         `json:"bodySize"`
+	Latency        time.Duration `json:"latency,omitempty"`        // from receiving the request to finishing the response
+	Disconnected   bool          `json:"disconnected,omitempty"`   // the client left before a streamed response ended
+	DisconnectedAt *time.Time    `json:"disconnectedAt,omitempty"` // when flytrap noticed the client was gone
+	Delivered      int           `json:"delivered,omitempty"`      // the events or chunks of a stream that were sent
+}
+
+// TLSInfo describes the tls connection a request was received on
+type TLSInfo struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipherSuite"`
+	ServerName         string `json:"serverName,omitempty"`
+	NegotiatedProtocol string `json:"negotiatedProtocol,omitempty"`
+
+	ClientCertificates []CertificateInfo `json:"clientCertificates,omitempty"` // the chain the client presented, leaf first
+	ClientVerified     bool              `json:"clientVerified,omitempty"`     // the chain verified against the client CA bundle
+	ClientVerifyError  string            `json:"clientVerifyError,omitempty"`
+}
+
+// CertificateInfo describes a certificate presented by a client
+type CertificateInfo struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serialNumber"`
+	SHA256Fingerprint string    `json:"sha256Fingerprint"`
+	NotBefore         time.Time `json:"notBefore"`
+	NotAfter          time.Time `json:"notAfter"`
+	DNSNames          []string  `json:"dnsNames,omitempty"`
+	EmailAddresses    []string  `json:"emailAddresses,omitempty"`
+}
+
+func newCertificateInfo(cert *x509.Certificate) CertificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return CertificateInfo{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      fmt.Sprintf("%X", cert.SerialNumber),
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		DNSNames:          cert.DNSNames,
+		EmailAddresses:    cert.EmailAddresses,
+	}
+}
+
+// newCapturedRequest reads the request, including its body and trailers. Only the first limit bytes of the body
+// are kept, a longer body is marked truncated and the rest is left for later handlers, see drainBody.
+// The request body is restored so it can still be read in full by later handlers.
+func newCapturedRequest(r *http.Request, limit int64) (*CapturedRequest, error) {
+	cr := &CapturedRequest{
+		ID:               uuid.New().String(),
+		Method:           r.Method,
+		Proto:            r.Proto,
+		Host:             r.Host,
+		Path:             r.URL.Path,
+		RawQuery:         r.URL.RawQuery,
+		Header:           r.Header.Clone(),
+		TransferEncoding: r.TransferEncoding,
+		ContentLength:    r.ContentLength,
+		RemoteAddr:       r.RemoteAddr,
+		StreamID:         streamID(r),
+		ReceivedAt:       time.Now(),
+	}
+
+	if r.Body != nil {
+		rest := &requestBody{ReadCloser: r.Body}
+		body, err := io.ReadAll(io.LimitReader(rest, limit+1))
+		cr.Body = body
+		cr.BodySize = int64(len(body))
+		if err != nil {
+			r.Body.Close()
+			return cr, err
+		}
+		if cr.BodySize > limit {
+			cr.Body, cr.BodyTruncated = body[:limit:limit], true
+			rest.read = bytes.NewReader(body)
+			r.Body = rest
+		} else {
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+	// trailers are only populated once the body has been read
+	if len(r.Trailer) > 0 {
+		cr.Trailer = r.Trailer.Clone()
+	}
+
+	if r.TLS != nil {
+		cr.TLS = &TLSInfo{
+			Version:            tls.VersionName(r.TLS.Version),
+			CipherSuite:        tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:         r.TLS.ServerName,
+			NegotiatedProtocol: r.TLS.NegotiatedProtocol,
+			ClientVerified:     len(r.TLS.VerifiedChains) > 0,
+		}
+		for _, cert := range r.TLS.PeerCertificates {
+			cr.TLS.ClientCertificates = append(cr.TLS.ClientCertificates, newCertificateInfo(cert))
+		}
+	}
+	return cr, nil
+}
+
+// requestBody is the body of a request that was longer than what was kept of it,
+// what was read while capturing it is handed out again before the rest
+type requestBody struct {
+	io.ReadCloser               // what the client sends
+	read          *bytes.Reader // what was already read of it
+	size          int64         // how much was read from the client
+}
+
+func (rb *requestBody) Read(b []byte) (int, error) {
+	if rb.read != nil && rb.read.Len() > 0 {
+		return rb.read.Read(b)
+	}
+	n, err := rb.ReadCloser.Read(b)
+	rb.size += int64(n)
+	return n, err
+}
+
+// drainBody reads what is left of a body that was cut short when the request was captured, once it has been
+// answered, so that cr has the size of the whole body and its trailers. Nothing of it is held on to.
+func drainBody(r *http.Request, cr *CapturedRequest) {
+	rb, ok := r.Body.(*requestBody)
+	if !ok {
+		return
+	}
+	io.Copy(io.Discard, rb)
+	cr.BodySize = rb.size
+	if len(r.Trailer) > 0 {
+		cr.Trailer = r.Trailer.Clone()
+	}
+}
+
+// URL returns the request uri the client asked for
+func (cr *CapturedRequest) URL() *url.URL {
+	return &url.URL{Path: cr.Path, RawQuery: cr.RawQuery}
+}
+
+// Request rebuilds an http.Request from the captured data
+func (cr *CapturedRequest) Request() *http.Request {
+	major, minor, ok := http.ParseHTTPVersion(cr.Proto)
+	if !ok {
+		major, minor = 1, 1
+	}
+	return &http.Request{
+		Method:           cr.Method,
+		URL:              cr.URL(),
+		Proto:            cr.Proto,
+		ProtoMajor:       major,
+		ProtoMinor:       minor,
+		Header:           cr.Header.Clone(),
+		Trailer:          cr.Trailer.Clone(),
+		TransferEncoding: cr.TransferEncoding,
+		Body:             io.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength:    cr.contentLength(),
+		Host:             cr.Host,
+		RemoteAddr:       cr.RemoteAddr,
+	}
+}
+
+// contentLength is the length of the stored body, which is shorter than what was sent when it was truncated
+func (cr *CapturedRequest) contentLength() int64 {
+	if cr.BodyTruncated && cr.ContentLength > 0 {
+		return int64(len(cr.Body))
+	}
+	return cr.ContentLength
+}
+
+// truncatedBodyMarker is appended to the dump of a request whose body was not stored in full
+const truncatedBodyMarker = "\n... [flytrap: body truncated, %d of %d bytes stored]"
+
+// Dump returns the request in its http/1.x wire representation
+func (cr *CapturedRequest) Dump() []byte {
+	dump, err := httputil.DumpRequest(cr.Request(), true)
+	if err != nil {
+		// the body is in memory so this can only fail on a malformed request, show what we have
+		return []byte(err.Error())
+	}
+	if cr.BodyTruncated {
+		dump = fmt.Appendf(dump, truncatedBodyMarker, len(cr.Body), cr.BodySize)
+	}
+	// DumpRequest leaves out trailers
+	if len(cr.Trailer) > 0 {
+		dump = append(dump, "\n\nTrailers:\n"...)
+		var b bytes.Buffer
+		cr.Trailer.Write(&b)
+		dump = append(dump, b.Bytes()...)
+	}
+	return dump
+}
+
+// size estimates the memory a stored request takes
+func (cr *CapturedRequest) size() int64 {
+	size := int64(len(cr.Path)+len(cr.RawQuery)+len(cr.Host)+256) + cr.bodyBytes() + headerSize(cr.Header) + headerSize(cr.Trailer)
+	for _, resp := range cr.responses() {
+		size += headerSize(resp.Header) + headerSize(resp.Trailer)
+	}
+	if cr.Upstream != nil {
+		size += int64(len(cr.Upstream.URL) + len(cr.Upstream.Error))
+	}
+	return size
+}
+
+// responses returns the responses stored with the request
+func (cr *CapturedRequest) responses() []*CapturedResponse {
+	resps := []*CapturedResponse{}
+	if cr.Response != nil {
+		resps = append(resps, cr.Response)
+	}
+	if cr.Upstream != nil && cr.Upstream.Response != nil {
+		resps = append(resps, cr.Upstream.Response)
+	}
+	return resps
+}
+
+// bodyBytes is the size of all the bodies stored with the request
+func (cr *CapturedRequest) bodyBytes() int64 {
+	size := int64(len(cr.Body))
+	for _, resp := range cr.responses() {
+		size += int64(len(resp.Body))
+	}
+	if cr.WebSocket != nil {
+		for _, f := range cr.WebSocket.Frames {
+			size += int64(len(f.Payload))
+		}
+	}
+	if cr.GRPC != nil {
+		for _, m := range cr.GRPC.Requests {
+			size += int64(len(m.JSON))
+		}
+		for _, m := range cr.GRPC.Responses {
+			size += int64(len(m.JSON))
+		}
+	}
+	return size
+}
+
+func headerSize(h http.Header) int64 {
+	var size int64
+	for name, values := range h {
+		for _, v := range values {
+			size += int64(len(name) + len(v))
+		}
+	}
+	return size
+}
+
+// truncated returns a copy of the request with its bodies cut down to max bytes,
+// or the request itself if its bodies already fit
+func (cr *CapturedRequest) truncated(max int64) *CapturedRequest {
+	if max <= 0 {
+		return cr
+	}
+	t := *cr
+	changed := false
+	if int64(len(cr.Body)) > max {
+		t.Body = cr.Body[:max:max]
+		t.BodyTruncated = true
+		changed = true
+	}
+	if resp := cr.Response.truncated(max); resp != cr.Response {
+		t.Response = resp
+		changed = true
+	}
+	if cr.Upstream != nil {
+		if resp := cr.Upstream.Response.truncated(max); resp != cr.Upstream.Response {
+			up := *cr.Upstream
+			up.Response = resp
+			t.Upstream = &up
+			changed = true
+		}
+	}
+	if call := cr.GRPC.truncated(max); call != cr.GRPC {
+		t.GRPC = call
+		changed = true
+	}
+	if ws := cr.WebSocket.truncated(max); ws != cr.WebSocket {
+		t.WebSocket = ws
+		changed = true
+	}
+	if !changed {
+		return cr
+	}
+	return &t
+}
+
+// truncated returns a copy of the response with its body cut down to max bytes,
+// or the response itself if the body already fits
+func (cr *CapturedResponse) truncated(max int64) *CapturedResponse {
+	if cr == nil || int64(len(cr.Body)) <= max {
+		return cr
+	}
+	t := *cr
+	t.Body = cr.Body[:max:max]
+	t.BodyTruncated = true
+	return &t
+}
+
+// recordResponse records an http response as its body is read by whoever passes it on, the body is not held up.
+// The first maxRecordedBody bytes are kept, the record is complete once the body is closed.
+func recordResponse(resp *http.Response) *CapturedResponse {
+	cr := &CapturedResponse{
+		Status: resp.StatusCode,
+		Proto:  resp.Proto,
+		Header: resp.Header.Clone(),
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, resp: resp, cr: cr}
+	return cr
+}
+
+// recordingBody keeps a copy of a response body while it is read
+type recordingBody struct {
+	io.ReadCloser
+	resp *http.Response
+	cr   *CapturedResponse
+	body bytes.Buffer
+}
+
+func (rb *recordingBody) Read(b []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(b)
+	rb.cr.BodySize += int64(n)
+	if room := maxRecordedBody - rb.body.Len(); room > 0 {
+		rb.body.Write(b[:min(n, room)])
+	}
+	return n, err
+}
+
+// Close completes the record, the trailers are known once the body was read
+func (rb *recordingBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.cr.Body = rb.body.Bytes()
+	rb.cr.BodyTruncated = int64(len(rb.cr.Body)) < rb.cr.BodySize
+	if len(rb.resp.Trailer) > 0 {
+		rb.cr.Trailer = rb.resp.Trailer.Clone()
+	}
+	return err
+}
+
+// Dump returns the response in its http/1.x wire representation
+func (cr *CapturedResponse) Dump() []byte {
+	major, minor, ok := http.ParseHTTPVersion(cr.Proto)
+	if !ok {
+		major, minor = 1, 1
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", cr.Status, http.StatusText(cr.Status)),
+		StatusCode:    cr.Status,
+		Proto:         cr.Proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        cr.Header.Clone(),
+		Trailer:       cr.Trailer.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+	}
+	// the body was read fully, dump it with its actual length rather than how it was framed
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Transfer-Encoding")
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return []byte(err.Error())
+	}
+	if cr.BodyTruncated {
+		dump = fmt.Appendf(dump, truncatedBodyMarker, len(cr.Body), cr.BodySize)
+	}
+	// DumpResponse leaves out trailers
+	if len(cr.Trailer) > 0 {
+		dump = append(dump, "\n\nTrailers:\n"...)
+		var b bytes.Buffer
+		cr.Trailer.Write(&b)
+		dump = append(dump, b.Bytes()...)
+	}
+	return dump
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapturedRequestBodyLimit(t *testing.T) {
+	captured := make(chan *CapturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr, err := newCapturedRequest(r, 5)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(cr.Body) != "hello" || !cr.BodyTruncated {
+			t.Errorf("got body %q truncated %v, want the first 5 bytes marked truncated", cr.Body, cr.BodyTruncated)
+		}
+		// later handlers still get all of it
+		if r.URL.Path == "/read" {
+			if body, _ := io.ReadAll(r.Body); string(body) != "hello world" {
+				t.Errorf("the handler read %q, want the whole body", body)
+			}
+		}
+		drainBody(r, cr)
+		captured <- cr
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/read", "/unread"} {
+		req, _ := http.NewRequest("POST", srv.URL+path, io.MultiReader(strings.NewReader("hello world")))
+		req.Trailer = http.Header{"X-Checksum": {"abc"}}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		cr := <-captured
+		if cr.BodySize != 11 || cr.Trailer.Get("X-Checksum") != "abc" {
+			t.Errorf("%s: got body size %d and trailer %q, want 11 and abc", path, cr.BodySize, cr.Trailer.Get("X-Checksum"))
+		}
+	}
+}
+
+func TestCapturedRequestRecord(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://flytrap:9000/hooks/x?a=1&b=2", strings.NewReader("\x00binary"))
+	r.Header.Add("X-Multi", "one")
+	r.Header.Add("X-Multi", "two")
+	cr, err := newCapturedRequest(r, maxRecordedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Method != "POST" || cr.Host != "flytrap:9000" || cr.Path != "/hooks/x" || cr.RawQuery != "a=1&b=2" {
+		t.Errorf("got %s %s %s?%s, want the request line as sent", cr.Method, cr.Host, cr.Path, cr.RawQuery)
+	}
+	if string(cr.Body) != "\x00binary" || cr.BodySize != 7 || cr.BodyTruncated {
+		t.Errorf("got body %q of size %d, want the whole binary body", cr.Body, cr.BodySize)
+	}
+
+	// the record survives storage as json, repeated headers and binary bodies included
+	data, err := json.Marshal(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored CapturedRequest
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Header, cr.Header) || string(stored.Body) != string(cr.Body) || !stored.ReceivedAt.Equal(cr.ReceivedAt) {
+		t.Errorf("got %+v back from json, want %+v", stored, cr)
+	}
+	if got := stored.Request().Header.Values("X-Multi"); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("the rebuilt request has X-Multi %q, want both values", got)
+	}
+}
+
+func TestCapturedRequestDump(t *testing.T) {
+	cr := &CapturedRequest{
+		Method: "POST", Proto: "HTTP/1.1", Host: "flytrap", Path: "/up", Header: http.Header{},
+		TransferEncoding: []string{"chunked"}, Trailer: http.Header{"X-Checksum": {"abc"}},
+		Body: []byte("hel"), BodyTruncated: true, BodySize: 5, ContentLength: -1,
+	}
+	dump := string(cr.Dump())
+	for _, want := range []string{"POST /up HTTP/1.1\r\n", "Host: flytrap\r\n", "hel", "3 of 5 bytes stored", "Trailers:\nX-Checksum: abc"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("the dump has no %q:\n%s", want, dump)
+		}
+	}
+}
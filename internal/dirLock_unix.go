@@ -0,0 +1,27 @@
+//go:build unix
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir takes the lock on a data dir, it is held until the returned file is closed.
+// The lock goes away with the process, a flytrap that crashed doesn't leave its data dir locked.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errDirLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,447 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCompactInterval sets how often the disk store checks whether it should compact its segments
+const DefaultCompactInterval = time.Minute * 10
+
+// maxSegmentSize is the size after which the disk store starts writing to a new segment file
+const maxSegmentSize = 64 << 20
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+)
+
+// lockFile is locked by the flytrap writing to a data dir, so an import doesn't write to it at the same time
+const lockFile = "flytrap.lock"
+
+var errDirLocked = errors.New("the data dir is in use by a running flytrap")
+
+// log entry operations
+const (
+	opAppend = "append"
+	opDelete = "delete"
+	opRemove = "remove"
+	opUpdate = "update"
+	opReset  = "reset" // starts a compacted segment, everything before it is superseded
+)
+
+// logEntry is a single line of a segment file
+type logEntry struct {
+	Op      string           `json:"op"`
+	Key     string           `json:"key,omitempty"`
+	Request *CapturedRequest `json:"request,omitempty"`
+	IDs     []string         `json:"ids,omitempty"`
+}
+
+// diskStore persists every change as a json line in append only segment files, so captures survive restarts.
+// Reads are served from memory, the segments are replayed into memory when the store is opened.
+// Entries are written without an fsync: they survive the process dying but not the machine.
+type diskStore struct {
+	mem  storage
+	dir  string
+	lock *os.File // held while the store is open
+
+	mu          sync.Mutex // serializes writes and compaction
+	segment     *os.File
+	segmentID   int
+	segmentSize int64
+	entrySizes  map[string]int64 // bytes on disk of each stored request, by request id
+	liveBytes   int64            // bytes in the segments that are still needed
+	totalBytes  int64            // bytes in all segments
+}
+
+// newDiskStore opens, or creates, the store in dir and keeps it compacted
+func newDiskStore(dir string) (*diskStore, error) {
+	ds, err := openDiskStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	go ds.compactLoop(DefaultCompactInterval)
+	return ds, nil
+}
+
+// openDiskStore opens, or creates, the store in dir, locking it until close. It fails if the store is locked already.
+func openDiskStore(dir string) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	ds := &diskStore{mem: newMemStore(), dir: dir, lock: lock, entrySizes: make(map[string]int64)}
+	if err := ds.replay(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	// start from a compact state so a restart doesn't drag old garbage along
+	if err := ds.compact(); err != nil {
+		ds.close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+// close closes the current segment and releases the lock on the store, it must not be used afterwards
+func (ds *diskStore) close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var err error
+	if ds.segment != nil {
+		err = ds.segment.Close()
+		ds.segment = nil
+	}
+	return errors.Join(err, ds.lock.Close())
+}
+
+// readDiskStore loads the store in dir without writing to it, so it can be read while flytrap is running.
+// The result does not see later changes.
+func readDiskStore(dir string) (storage, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	ds := &diskStore{mem: newMemStore(), dir: dir, entrySizes: make(map[string]int64)}
+	if err := ds.replay(); err != nil {
+		return nil, err
+	}
+	return ds.mem, nil
+}
+
+// segments lists the segment ids in dir in the order they were written
+func (ds *diskStore) segments() ([]int, error) {
+	files, err := filepath.Glob(filepath.Join(ds.dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, f := range files {
+		var id int
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), segmentPrefix), segmentSuffix)
+		if _, err := fmt.Sscanf(name, "%d", &id); err != nil {
+			log.Printf("Ignoring unexpected file in store: %s", f)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (ds *diskStore) segmentPath(id int) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("%s%08d%s", segmentPrefix, id, segmentSuffix))
+}
+
+// replay loads all segments into memory
+func (ds *diskStore) replay() error {
+	ids, err := ds.segments()
+	if err != nil {
+		return err
+	}
+	entries := 0
+	for _, id := range ids {
+		n, err := ds.replaySegment(id)
+		if err != nil {
+			return err
+		}
+		entries += n
+		ds.segmentID = id
+	}
+	log.Printf("Store loaded %d entries from %d segments in %s", entries, len(ids), ds.dir)
+	return nil
+}
+
+func (ds *diskStore) replaySegment(id int) (int, error) {
+	f, err := os.Open(ds.segmentPath(id))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// a write that was cut short when the process died
+				log.Printf("Store ignoring truncated entry at the end of segment %d", id)
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		ds.totalBytes += int64(len(line))
+		var e logEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("Store ignoring unreadable entry in segment %d: %v", id, err)
+			continue
+		}
+		ds.apply(e, int64(len(line)))
+		n++
+	}
+}
+
+// apply replays an entry that took size bytes on disk into memory
+func (ds *diskStore) apply(e logEntry, size int64) {
+	switch e.Op {
+	case opAppend:
+		ds.mem.append(e.Key, e.Request)
+		ds.track(e.Request, size)
+	case opDelete:
+		ds.untrack(e.Key)
+		ds.mem.delete(e.Key)
+	case opUpdate:
+		if ds.mem.update(e.Key, e.Request) {
+			ds.untrackIDs([]string{e.Request.ID})
+			ds.track(e.Request, size)
+		}
+	case opRemove:
+		ds.untrackIDs(e.IDs)
+		ds.mem.remove(e.Key, e.IDs...)
+	case opReset:
+		ds.mem = newMemStore()
+		ds.entrySizes = make(map[string]int64)
+		ds.liveBytes = 0
+	default:
+		log.Printf("Store ignoring unknown entry op: %s", e.Op)
+	}
+}
+
+// write appends an entry to the current segment, rolling over to a new one when it is full.
+// Callers must hold ds.mu.
+func (ds *diskStore) write(e logEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if ds.segment == nil || ds.segmentSize+int64(len(line)) > maxSegmentSize {
+		if err := ds.roll(); err != nil {
+			return err
+		}
+	}
+	n, err := ds.segment.Write(line)
+	ds.segmentSize += int64(n)
+	ds.totalBytes += int64(n)
+	switch e.Op {
+	case opAppend:
+		ds.track(e.Request, int64(n))
+	case opUpdate:
+		// the previous version of the request is garbage now
+		ds.untrackIDs([]string{e.Request.ID})
+		ds.track(e.Request, int64(n))
+	}
+	return err
+}
+
+// track accounts for a request that is live on disk
+func (ds *diskStore) track(cr *CapturedRequest, size int64) {
+	ds.entrySizes[cr.ID] = size
+	ds.liveBytes += size
+}
+
+// untrack marks everything stored for key as garbage, it must be called before the key is deleted from memory
+func (ds *diskStore) untrack(key string) {
+	for _, v := range ds.mem.load(key) {
+		ds.untrackIDs([]string{v.ID})
+	}
+}
+
+func (ds *diskStore) untrackIDs(ids []string) {
+	for _, id := range ids {
+		ds.liveBytes -= ds.entrySizes[id]
+		delete(ds.entrySizes, id)
+	}
+}
+
+// roll closes the current segment and opens the next one. Callers must hold ds.mu.
+func (ds *diskStore) roll() error {
+	if ds.segment != nil {
+		if err := ds.segment.Close(); err != nil {
+			return err
+		}
+	}
+	ds.segmentID++
+	f, err := os.OpenFile(ds.segmentPath(ds.segmentID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		ds.segment = nil
+		return err
+	}
+	ds.segment = f
+	ds.segmentSize = 0
+	return nil
+}
+
+// compact writes the live data into a new segment and removes all older segments.
+// The new segment is only put in place once it is complete and it starts with a reset entry,
+// so a crash at any point replays to the same state.
+func (ds *diskStore) compact() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	old, err := ds.segments()
+	if err != nil {
+		return err
+	}
+	id := ds.segmentID + 1
+	tmp := ds.segmentPath(id) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	sizes := make(map[string]int64)
+	var size int64
+	writeEntry := func(e logEntry) error {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		n, err := w.Write(append(line, '\n'))
+		size += int64(n)
+		if e.Request != nil {
+			sizes[e.Request.ID] = int64(n)
+		}
+		return err
+	}
+
+	werr := writeEntry(logEntry{Op: opReset})
+	ds.mem.foreach(func(key string, values []*CapturedRequest) bool {
+		for _, v := range values {
+			if werr != nil {
+				return false
+			}
+			werr = writeEntry(logEntry{Op: opAppend, Key: key, Request: v})
+		}
+		return werr == nil
+	})
+	if werr == nil {
+		werr = w.Flush()
+	}
+	if werr == nil {
+		werr = f.Sync()
+	}
+	f.Close()
+	if werr != nil {
+		return werr
+	}
+	if err := os.Rename(tmp, ds.segmentPath(id)); err != nil {
+		return err
+	}
+
+	// continue appending to the compacted segment
+	if ds.segment != nil {
+		ds.segment.Close()
+	}
+	ds.segment, err = os.OpenFile(ds.segmentPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		ds.segment = nil
+		return err
+	}
+	ds.segmentID = id
+	ds.segmentSize = size
+	ds.entrySizes = sizes
+	ds.totalBytes = size
+	ds.liveBytes = size
+
+	for _, oldID := range old {
+		if err := os.Remove(ds.segmentPath(oldID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactLoop compacts once more than half of what is on disk is no longer needed
+func (ds *diskStore) compactLoop(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		ds.mu.Lock()
+		garbage := ds.totalBytes - ds.liveBytes
+		needed := garbage > ds.liveBytes
+		ds.mu.Unlock()
+		if !needed {
+			continue
+		}
+		log.Printf("Store compacting %d bytes of expired data", garbage)
+		if err := ds.compact(); err != nil {
+			log.Printf("Store compaction failed: %v", err)
+		}
+	}
+}
+
+func (ds *diskStore) append(key string, value *CapturedRequest) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := ds.write(logEntry{Op: opAppend, Key: key, Request: value}); err != nil {
+		log.Printf("Store error persisting request on path: %s error: %v", key, err)
+	}
+	ds.mem.append(key, value)
+}
+
+func (ds *diskStore) update(key string, value *CapturedRequest) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.mem.update(key, value) {
+		return false
+	}
+	if err := ds.write(logEntry{Op: opUpdate, Key: key, Request: value}); err != nil {
+		log.Printf("Store error persisting update on path: %s error: %v", key, err)
+	}
+	return true
+}
+
+func (ds *diskStore) exists(key string) bool {
+	return ds.mem.exists(key)
+}
+
+func (ds *diskStore) load(key string) []*CapturedRequest {
+	return ds.mem.load(key)
+}
+
+func (ds *diskStore) foreach(f func(key string, values []*CapturedRequest) bool) {
+	ds.mem.foreach(f)
+}
+
+func (ds *diskStore) delete(key string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !ds.mem.exists(key) {
+		return false
+	}
+	if err := ds.write(logEntry{Op: opDelete, Key: key}); err != nil {
+		log.Printf("Store error persisting delete of path: %s error: %v", key, err)
+	}
+	ds.untrack(key)
+	return ds.mem.delete(key)
+}
+
+func (ds *diskStore) remove(key string, ids ...string) int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if len(ids) == 0 || !ds.mem.exists(key) {
+		return 0
+	}
+	if err := ds.write(logEntry{Op: opRemove, Key: key, IDs: ids}); err != nil {
+		log.Printf("Store error persisting removal on path: %s error: %v", key, err)
+	}
+	ds.untrackIDs(ids)
+	return ds.mem.remove(key, ids...)
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ids lists the ids stored on key, in order
+func ids(s storage, key string) []string {
+	ids := []string{}
+	for _, v := range s.load(key) {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+func TestDiskStoreReplayAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := openDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.append("/a", testRequest("1"))
+	ds.append("/a", testRequest("2"))
+	ds.append("/a", testRequest("3"))
+	ds.append("/gone", testRequest("4"))
+	answered := testRequest("1")
+	answered.Response = &CapturedResponse{Status: 201}
+	ds.update("/a", answered)
+	ds.remove("/a", "2")
+	ds.delete("/gone")
+	if err := ds.compact(); err != nil {
+		t.Fatal(err)
+	}
+	// changes after the compaction land after its reset entry
+	ds.append("/b", testRequest("5"))
+	ds.remove("/a", "3")
+	if err := ds.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if len(segments) != 1 {
+		t.Errorf("got segments %v, want only the compacted one", segments)
+	}
+	reopened, err := openDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	if got := ids(reopened, "/a"); len(got) != 1 || got[0] != "1" {
+		t.Errorf("got %v on /a, want only request 1", got)
+	}
+	if a := reopened.load("/a"); len(a) == 1 && (a[0].Response == nil || a[0].Response.Status != 201) {
+		t.Errorf("got response %+v, want the update to survive the compaction", a[0].Response)
+	}
+	if got := ids(reopened, "/b"); len(got) != 1 || got[0] != "5" {
+		t.Errorf("got %v on /b, want request 5", got)
+	}
+	if reopened.exists("/gone") {
+		t.Error("a deleted path came back")
+	}
+}
+
+func TestDiskStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := openDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.append("/a", testRequest("1"))
+	ds.close()
+
+	// the process died in the middle of the next write
+	segments, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"append","key":"/a","request":{"id":"2"`)
+	f.Close()
+
+	replayed, err := readDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(replayed, "/a"); len(got) != 1 || got[0] != "1" {
+		t.Errorf("got %v, want the complete entry only", got)
+	}
+}
@@ -3,8 +3,8 @@ package internal
 import (
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,39 +16,192 @@ const DefaultHandlerTTL = time.Minute * 30
 const DefaultPruneTicker = time.Minute * 1
 
 type expiringHandler struct {
-	*http.HandlerFunc           // the actual handler
-	lastAccessed      time.Time // the last time this handler was accessed
+	*http.HandlerFunc              // the actual handler
+	lastAccessed      atomic.Int64 // the last time this handler was accessed, in unix nanos
 	path              string
-	store             storage
+	env               *captureEnv
 }
 
-func newexpiringHandler(path string, store storage) expiringHandler {
-	eh := expiringHandler{path: path, store: store}
+func newexpiringHandler(path string, env *captureEnv) *expiringHandler {
+	eh := &expiringHandler{path: path, env: env}
 	h := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		// Capture the request
-		request.Header.Add("X-Recv-Timestamp", time.Now().Format(time.StampMilli))
-		rbuf, _ := httputil.DumpRequest(request, true)
-		eh.store.append(eh.path, rbuf)
-		eh.lastAccessed = time.Now()
+		cr, err := newCapturedRequest(request, eh.env.maxBody)
+		if err != nil {
+			log.Printf("Error reading request body on path: %s error: %v", eh.path, err)
+		}
+		if cr.TLS != nil {
+			cr.TLS.verifyClient(request.TLS, eh.env.clientCAs)
+		}
+		if isGRPC(request) {
+			cr.GRPC = newGRPCCall(cr, eh.env.protos)
+		}
+		eh.env.capture(eh.path, cr)
+		eh.touch()
+
+		// Reply with the configured response, or forward to the configured upstream, if any,
+		// recording whatever was sent back. A fault configured for the path gets to misbehave first.
+		rec := newResponseRecorder(writer, cr.ReceivedAt)
+		done := *cr
+		var w http.ResponseWriter = rec
+		faulted := false
+		if fr := eh.env.faults.lookup(eh.path, request.Method); fr != nil {
+			w, done.Fault, faulted = fr.apply(rec, request)
+		}
+		mr := eh.env.responses.lookup(eh.path, request.Method)
+		pr := eh.env.proxies.lookup(eh.path)
+		disconnected, aborted, delivered := false, false, 0
+		switch {
+		case faulted:
+			// already answered, or deliberately left unanswered
+		// websockets are answered by flytrap unless the path has a plain response or is forwarded
+		case isWebsocketUpgrade(request) && (mr != nil && mr.WebSocket != nil || mr == nil && pr == nil):
+			var script *wsScript
+			if mr != nil {
+				script = mr.WebSocket
+			}
+			done.Response, done.WebSocket = serveWebsocket(w, request, script, func(resp *CapturedResponse, ws *WebSocketSession) {
+				eh.touch()
+				progress := *cr
+				progress.Response, progress.WebSocket = resp, ws
+				eh.env.progress(eh.path, &progress)
+			})
+		// so are grpc calls, with an empty OK reply unless the path has a grpc reply
+		case cr.GRPC != nil && (mr != nil && mr.GRPC != nil || mr == nil && pr == nil):
+			reply := &grpcReply{}
+			if mr != nil {
+				reply = mr.GRPC
+			}
+			reply.write(w)
+		case mr != nil && mr.sequence != nil:
+			mr.next().write(request.Context(), w)
+		case mr != nil && mr.Stream != nil:
+			delivered, disconnected = mr.Stream.write(request.Context(), w, mr)
+		case mr != nil && mr.Echo:
+			writeEcho(w, eh.path, cr, mr)
+		case mr != nil:
+			mr.write(w, cr)
+		case pr != nil:
+			done.Upstream, aborted = pr.forward(w, request)
+			disconnected = aborted && request.Context().Err() != nil
+			if ur := done.Upstream.Response; ur != nil && ur.Status == http.StatusSwitchingProtocols {
+				// the proxy wrote the switch straight to the hijacked connection, past the recorder
+				done.Response = ur
+			}
+		case eh.env.echo:
+			writeEcho(w, eh.path, cr, nil)
+		}
+		// a request the fault answered without a status got no response at all
+		if done.Response == nil && !(faulted && done.Fault.Status == 0) {
+			done.Response = rec.response(request.Proto)
+			done.Response.Delivered = delivered
+			if disconnected {
+				at := time.Now()
+				done.Response.Disconnected, done.Response.DisconnectedAt = true, &at
+			}
+		}
+		if cr.GRPC != nil {
+			done.GRPC = cr.GRPC.completed(done.Response, eh.env.protos)
+		}
+		drainBody(request, &done)
+		eh.env.complete(eh.path, &done)
+		if done.Fault != nil && done.Fault.Connection == faultReset {
+			resetConnection(rec)
+		}
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
 	})
 	eh.HandlerFunc = &h
-	eh.lastAccessed = time.Now()
+	eh.touch()
 
 	return eh
 }
 
-func pruneHandlers(ttl time.Duration, handlers *sync.Map) {
-	for range time.NewTicker(getHandlerTTL()).C {
-		handlers.Range(func(key, value interface{}) bool {
-			h := value.(expiringHandler)
-			age := time.Now().Sub(h.lastAccessed)
-			if age >= ttl {
-				// delete
-				log.Printf("Pruning old handler for path: %s Age: %v", h.path, age)
-				handlers.Delete(key)
-				h.store.delete(h.path)
+func (eh *expiringHandler) touch() {
+	eh.lastAccessed.Store(time.Now().UnixNano())
+}
+
+// age is how long it has been since the handler was last accessed
+func (eh *expiringHandler) age() time.Duration {
+	return time.Since(time.Unix(0, eh.lastAccessed.Load()))
+}
+
+// restoreHandlers installs handlers for the paths already in the store, eg: loaded from disk,
+// so they expire like paths captured since startup. Paths of bins that are gone are dropped.
+func restoreHandlers(env *captureEnv, handlers *sync.Map) {
+	env.store.foreach(func(key string, values []*CapturedRequest) bool {
+		if id, ok := binID(key); ok {
+			if _, ok := env.bins.get(id); !ok {
+				log.Printf("Dropping path: %s of bin: %s that no longer exists", key, id)
+				env.store.delete(key)
+				return true
 			}
-			return true
-		})
+		}
+		eh := newexpiringHandler(key, env)
+		if len(values) > 0 {
+			eh.lastAccessed.Store(values[len(values)-1].ReceivedAt.UnixNano())
+		}
+		handlers.Store(key, eh)
+		return true
+	})
+}
+
+// Expiry modes that can be selected with Config.Expiry
+const (
+	ExpiryPath    = "path"    // a path forgets all its requests once it has been inactive for the TTL
+	ExpiryRequest = "request" // each request is forgotten once it is older than the TTL
+)
+
+// pruneInterval is how often handlers are checked for expiry, often enough that nothing outlives the TTL by much
+func pruneInterval(ttl time.Duration) time.Duration {
+	if ttl/4 < DefaultPruneTicker {
+		return max(ttl/4, time.Millisecond)
+	}
+	return DefaultPruneTicker
+}
+
+func pruneHandlers(ttl time.Duration, mode string, handlers *sync.Map, env *captureEnv) {
+	for range time.NewTicker(pruneInterval(ttl)).C {
+		prune(ttl, mode, handlers, env)
+	}
+}
+
+// prune drops what has expired: requests in request mode, inactive bins, and the handlers of inactive paths
+// or, in request mode, of paths that have no requests left
+func prune(ttl time.Duration, mode string, handlers *sync.Map, env *captureEnv) {
+	if mode == ExpiryRequest {
+		expireRequests(ttl, env)
 	}
+	pruneBins(ttl, env, handlers)
+	handlers.Range(func(key, value interface{}) bool {
+		h := value.(*expiringHandler)
+		age := h.age()
+		if age >= env.bins.ttlFor(h.path, ttl) || (mode == ExpiryRequest && !h.env.store.exists(h.path)) {
+			// delete
+			log.Printf("Pruning old handler for path: %s Age: %v", h.path, age)
+			handlers.Delete(key)
+			h.env.store.delete(h.path)
+		}
+		return true
+	})
+}
+
+// expireRequests removes every request received more than ttl ago, or its bin's ttl
+func expireRequests(ttl time.Duration, env *captureEnv) {
+	store := env.store
+	store.foreach(func(key string, values []*CapturedRequest) bool {
+		cutoff := time.Now().Add(-env.bins.ttlFor(key, ttl))
+		expired := []string{}
+		for _, v := range values {
+			if v.ReceivedAt.Before(cutoff) {
+				expired = append(expired, v.ID)
+			}
+		}
+		if len(expired) > 0 {
+			log.Printf("Expiring %d requests on path: %s", len(expired), key)
+			store.remove(key, expired...)
+		}
+		return true
+	})
 }
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedAgo is a request received d ago
+func receivedAgo(id string, d time.Duration) *CapturedRequest {
+	cr := testRequest(id)
+	cr.ReceivedAt = time.Now().Add(-d)
+	return cr
+}
+
+func TestExpireRequests(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	b := env.bins.create("", 3*time.Hour)
+	env.store.append("/a", receivedAgo("old", 2*time.Hour))
+	env.store.append("/a", receivedAgo("new", time.Minute))
+	env.store.append(b.prefix()+"x", receivedAgo("in-bin", 2*time.Hour))
+
+	expireRequests(time.Hour, env)
+	if got := ids(env.store, "/a"); len(got) != 1 || got[0] != "new" {
+		t.Errorf("got %v on /a, want only the request younger than the TTL", got)
+	}
+	if got := ids(env.store, b.prefix()+"x"); len(got) != 1 {
+		t.Errorf("got %v in the bin, want the request kept for the longer TTL of the bin", got)
+	}
+}
+
+func TestPruneModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		kept bool
+	}{
+		// a path that is still being hit keeps its old requests
+		{ExpiryPath, true},
+		// a path whose requests all expired goes, however recently it was hit
+		{ExpiryRequest, false},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			env := newCaptureEnv(newMemStore(), "9000")
+			env.store.append("/a", receivedAgo("old", 2*time.Hour))
+			handlers := &sync.Map{}
+			handlers.Store("/a", newexpiringHandler("/a", env))
+
+			prune(time.Hour, tc.mode, handlers, env)
+			if _, ok := handlers.Load("/a"); ok != tc.kept || env.store.exists("/a") != tc.kept {
+				t.Errorf("handler kept: %v, path stored: %v, want both %v", ok, env.store.exists("/a"), tc.kept)
+			}
+		})
+	}
+}
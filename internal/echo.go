@@ -0,0 +1,16 @@
+package internal
+
+import "net/http"
+
+// writeEcho replies with the request as flytrap received it, in the same json the api returns for it.
+// A mock response can set the status and add headers, otherwise the reply is a 200.
+func writeEcho(w http.ResponseWriter, path string, cr *CapturedRequest, mr *mockResponse) {
+	status := http.StatusOK
+	if mr != nil {
+		status = mr.Status
+		for name, value := range mr.Headers {
+			w.Header().Set(name, value)
+		}
+	}
+	writeJSON(w, status, newAPIRequest(path, cr))
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		setup  func(env *captureEnv) error
+		status int
+		header string
+	}{
+		{"everywhere", func(env *captureEnv) error { env.echo = true; return nil }, http.StatusOK, ""},
+		{"on the path", func(env *captureEnv) error {
+			return env.responses.set(&mockResponse{Path: "/echo", Echo: true, Status: http.StatusAccepted,
+				Headers: map[string]string{"X-Flytrap": "echoed"}})
+		}, http.StatusAccepted, "echoed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newCaptureEnv(newMemStore(), "9000")
+			if err := tc.setup(env); err != nil {
+				t.Fatal(err)
+			}
+			capture, completed := captureServer(t, env, "/echo")
+			req, _ := http.NewRequest("PUT", capture.URL+"/echo?a=1", strings.NewReader("hello"))
+			req.Header.Set("X-Sent", "yes")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var echoed apiRequest
+			if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status || resp.Header.Get("X-Flytrap") != tc.header {
+				t.Errorf("got %d with header %q, want %d with %q", resp.StatusCode, resp.Header.Get("X-Flytrap"), tc.status, tc.header)
+			}
+			if echoed.Method != "PUT" || echoed.Path != "/echo" || echoed.Query.Get("a") != "1" ||
+				echoed.Headers.Get("X-Sent") != "yes" || echoed.Body != "hello" {
+				t.Errorf("got %+v, want the request that was sent", echoed)
+			}
+			// the echo is the request as it was captured
+			if cr := waitCompleted(t, completed); cr.ID != echoed.ID {
+				t.Errorf("echoed request %s, captured %s", echoed.ID, cr.ID)
+			}
+		})
+	}
+}
+
+func TestEchoCompile(t *testing.T) {
+	for _, mr := range []*mockResponse{
+		{Path: "/x", Echo: true, Template: true},
+		{Path: "/x", Echo: true, Sequence: []sequenceStep{{}}},
+		{Path: "/x", Echo: true, Stream: &streamScript{}},
+	} {
+		if err := mr.compile(); err == nil {
+			t.Errorf("got no error for echo with %+v", mr)
+		}
+	}
+}
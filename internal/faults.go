@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection faults a fault rule can inject
+const (
+	faultReset = "reset" // the connection is closed without a response, with a tcp reset where possible
+	faultHang  = "hang"  // no response is sent until the client gives up
+)
+
+// faultRule makes the capture server misbehave on a path, matched like mock responses.
+// Latency and Drip apply to every request, the failure (Status or Connection) only to the requests picked by
+// Probability, Every or Requests, or to every request when none of them are set.
+// Requests are counted from when the rule was set, starting at 1.
+type faultRule struct {
+	Path   string `json:"path"`
+	Method string `json:"method,omitempty"`
+
+	Latency *latency `json:"latency,omitempty"`
+	Drip    *drip    `json:"drip,omitempty"`
+
+	Probability float64 `json:"probability,omitempty"` // chance a request fails, 0 to 1
+	Every       int     `json:"every,omitempty"`       // every Nth request fails
+	Requests    []int   `json:"requests,omitempty"`    // these requests fail, eg: [1, 2] for the first two
+
+	Status     int               `json:"status,omitempty"` // the error status failing requests get
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	Connection string            `json:"connection,omitempty"` // faultReset or faultHang instead of a status
+
+	count atomic.Int64
+}
+
+// latency delays the response by a fixed duration, a uniformly random one between Min and Max,
+// or a normally distributed one around Mean
+type latency struct {
+	Fixed  duration `json:"fixed,omitempty"`
+	Min    duration `json:"min,omitempty"`
+	Max    duration `json:"max,omitempty"`
+	Mean   duration `json:"mean,omitempty"`
+	StdDev duration `json:"stddev,omitempty"`
+}
+
+// drip sends the response body Bytes at a time, waiting Interval before each piece
+type drip struct {
+	Bytes    int      `json:"bytes"`
+	Interval duration `json:"interval"`
+}
+
+// InjectedFault is what a fault rule did to a captured request
+type InjectedFault struct {
+	Latency    time.Duration `json:"latency,omitempty"`
+	Status     int           `json:"status,omitempty"`
+	Connection string        `json:"connection,omitempty"`
+	Drip       bool          `json:"drip,omitempty"`
+}
+
+// String lists what the fault did, eg: "latency 250ms, status 503"
+func (f *InjectedFault) String() string {
+	var parts []string
+	if f.Latency > 0 {
+		parts = append(parts, "latency "+f.Latency.String())
+	}
+	if f.Drip {
+		parts = append(parts, "drip")
+	}
+	if f.Status != 0 {
+		parts = append(parts, fmt.Sprintf("status %d", f.Status))
+	}
+	if f.Connection != "" {
+		parts = append(parts, "connection "+f.Connection)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (l *latency) compile() error {
+	kinds := 0
+	if l.Fixed > 0 {
+		kinds++
+	}
+	if l.Min > 0 || l.Max > 0 {
+		kinds++
+	}
+	if l.Mean > 0 || l.StdDev > 0 {
+		kinds++
+	}
+	if kinds != 1 {
+		return errors.New("latency needs one of fixed, min and max, or mean and stddev")
+	}
+	if l.Max < l.Min {
+		return fmt.Errorf("latency max %v is below min %v", time.Duration(l.Max), time.Duration(l.Min))
+	}
+	return nil
+}
+
+// pick draws the delay for a request, normally distributed delays are never negative
+func (l *latency) pick() time.Duration {
+	switch {
+	case l.Fixed > 0:
+		return time.Duration(l.Fixed)
+	case l.Max > 0:
+		return time.Duration(l.Min) + rand.N(time.Duration(l.Max-l.Min)+1)
+	}
+	return max(0, time.Duration(float64(l.Mean)+rand.NormFloat64()*float64(l.StdDev)))
+}
+
+func (fr *faultRule) compile() error {
+	if !strings.HasPrefix(fr.Path, "/") {
+		return fmt.Errorf("fault path must start with /: %q", fr.Path)
+	}
+	fr.Method = strings.ToUpper(fr.Method)
+	if fr.Latency != nil {
+		if err := fr.Latency.compile(); err != nil {
+			return err
+		}
+	}
+	if fr.Drip != nil && (fr.Drip.Bytes <= 0 || fr.Drip.Interval <= 0) {
+		return errors.New("drip needs a positive bytes and interval")
+	}
+	if fr.Probability < 0 || fr.Probability > 1 {
+		return fmt.Errorf("fault probability must be between 0 and 1: %v", fr.Probability)
+	}
+	if fr.Every < 0 {
+		return fmt.Errorf("fault every must be positive: %d", fr.Every)
+	}
+	if fr.Status != 0 && (fr.Status < 100 || fr.Status > 999) {
+		return fmt.Errorf("invalid fault status: %d", fr.Status)
+	}
+	switch fr.Connection {
+	case "", faultReset, faultHang:
+	default:
+		return fmt.Errorf("invalid fault connection: %q (use %s or %s)", fr.Connection, faultReset, faultHang)
+	}
+	if fr.Status != 0 && fr.Connection != "" {
+		return errors.New("a fault has either a status or a connection fault, not both")
+	}
+	if fr.Latency == nil && fr.Drip == nil && fr.Status == 0 && fr.Connection == "" {
+		return errors.New("a fault needs at least one of latency, drip, status or connection")
+	}
+	return nil
+}
+
+// fails counts the request and tells if it is one of the requests that fail
+func (fr *faultRule) fails() bool {
+	n := int(fr.count.Add(1))
+	if fr.Probability == 0 && fr.Every == 0 && len(fr.Requests) == 0 {
+		return true
+	}
+	return slices.Contains(fr.Requests, n) || fr.Every > 0 && n%fr.Every == 0 ||
+		fr.Probability > 0 && rand.Float64() < fr.Probability
+}
+
+// apply injects the fault before the request is answered. It returns the writer the response should be
+// written to, what was injected if anything, and whether the request was answered by the fault, in which case
+// nothing else should be written. A reset is left to the caller, see resetConnection, so the request can be stored first.
+func (fr *faultRule) apply(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *InjectedFault, bool) {
+	injected := &InjectedFault{}
+	if fr.Latency != nil {
+		injected.Latency = fr.Latency.pick()
+		select {
+		case <-time.After(injected.Latency):
+		case <-r.Context().Done():
+			return w, injected, true
+		}
+	}
+	if fr.Drip != nil {
+		injected.Drip = true
+		w = &dripWriter{ResponseWriter: w, drip: fr.Drip, ctx: r.Context().Done()}
+	}
+	if (fr.Status == 0 && fr.Connection == "") || !fr.fails() {
+		if *injected == (InjectedFault{}) {
+			return w, nil, false
+		}
+		return w, injected, false
+	}
+	switch fr.Connection {
+	case faultHang:
+		injected.Connection = faultHang
+		<-r.Context().Done()
+	case faultReset:
+		injected.Connection = faultReset
+	default:
+		injected.Status = fr.Status
+		for name, value := range fr.Headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(fr.Status)
+		w.Write([]byte(fr.Body))
+	}
+	return w, injected, true
+}
+
+// resetConnection drops the connection of an HTTP/1 request, with linger off so the client gets a tcp reset.
+// HTTP/2 connections can't be taken over, so only the stream is reset, by aborting the handler.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	raw := conn
+	for {
+		if tc, ok := raw.(interface{ NetConn() net.Conn }); ok {
+			raw = tc.NetConn()
+		} else if bc, ok := raw.(*bufferedConn); ok {
+			raw = bc.Conn
+		} else {
+			break
+		}
+	}
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// dripWriter slows a response down, writing its body a few bytes at a time
+type dripWriter struct {
+	http.ResponseWriter
+	drip *drip
+	ctx  <-chan struct{}
+}
+
+func (dw *dripWriter) Write(b []byte) (int, error) {
+	rc := http.NewResponseController(dw.ResponseWriter)
+	written := 0
+	for len(b) > 0 {
+		select {
+		case <-time.After(time.Duration(dw.drip.Interval)):
+		case <-dw.ctx:
+			return written, errors.New("flytrap: client disconnected")
+		}
+		piece := b[:min(len(b), dw.drip.Bytes)]
+		n, err := dw.ResponseWriter.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		rc.Flush()
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the flusher and hijacker of the underlying writer
+func (dw *dripWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// faultRules holds the configured faults, keyed by path and method
+type faultRules struct {
+	mu    sync.RWMutex
+	rules map[responseKey]*faultRule
+}
+
+func newFaultRules() *faultRules {
+	return &faultRules{rules: make(map[responseKey]*faultRule)}
+}
+
+// set compiles and installs a fault, replacing any existing one for the same path and method
+func (frs *faultRules) set(fr *faultRule) error {
+	if err := fr.compile(); err != nil {
+		return err
+	}
+	frs.mu.Lock()
+	defer frs.mu.Unlock()
+	frs.rules[responseKey{path: fr.Path, method: fr.Method}] = fr
+	return nil
+}
+
+func (frs *faultRules) remove(path, method string) bool {
+	frs.mu.Lock()
+	defer frs.mu.Unlock()
+	key := responseKey{path: path, method: strings.ToUpper(method)}
+	_, ok := frs.rules[key]
+	delete(frs.rules, key)
+	return ok
+}
+
+// lookup finds the fault for a request the same way responseRules.lookup finds responses
+func (frs *faultRules) lookup(path, method string) *faultRule {
+	frs.mu.RLock()
+	defer frs.mu.RUnlock()
+	find := func(path string) *faultRule {
+		if fr, ok := frs.rules[responseKey{path: path, method: method}]; ok {
+			return fr
+		}
+		return frs.rules[responseKey{path: path}]
+	}
+	if fr := find(path); fr != nil {
+		return fr
+	}
+	for prefix := path; prefix != ""; {
+		prefix = prefix[:strings.LastIndex(prefix, "/")]
+		if fr := find(prefix + wildcardSuffix); fr != nil {
+			return fr
+		}
+	}
+	return nil
+}
+
+// removePrefix removes all the faults for paths under prefix
+func (frs *faultRules) removePrefix(prefix string) {
+	frs.mu.Lock()
+	defer frs.mu.Unlock()
+	for key := range frs.rules {
+		if strings.HasPrefix(key.path, prefix) {
+			delete(frs.rules, key)
+		}
+	}
+}
+
+func (frs *faultRules) list() []*faultRule {
+	frs.mu.RLock()
+	defer frs.mu.RUnlock()
+	all := make([]*faultRule, 0, len(frs.rules))
+	for _, fr := range frs.rules {
+		all = append(all, fr)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Path != all[j].Path {
+			return all[i].Path < all[j].Path
+		}
+		return all[i].Method < all[j].Method
+	})
+	return all
+}
+
+// registerFaultAPI adds the endpoints to list, set and remove faults
+func registerFaultAPI(mux *http.ServeMux, frs *faultRules) {
+	mux.HandleFunc("GET /api/v1/faults", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, frs.list())
+	})
+
+	mux.HandleFunc("PUT /api/v1/faults", func(w http.ResponseWriter, r *http.Request) {
+		fr := &faultRule{}
+		if err := json.NewDecoder(r.Body).Decode(fr); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid fault: "+err.Error())
+			return
+		}
+		if err := frs.set(fr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, fr)
+	})
+
+	mux.HandleFunc("DELETE /api/v1/faults", func(w http.ResponseWriter, r *http.Request) {
+		path, method := r.URL.Query().Get("path"), r.URL.Query().Get("method")
+		if !frs.remove(path, method) {
+			writeError(w, http.StatusNotFound, "no fault configured for path: "+path+" method: "+method)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// pieceWriter records every write that reaches the connection
+type pieceWriter struct {
+	*httptest.ResponseRecorder
+	pieces []string
+}
+
+func (pw *pieceWriter) Write(b []byte) (int, error) {
+	pw.pieces = append(pw.pieces, string(b))
+	return pw.ResponseRecorder.Write(b)
+}
+
+func TestFaultDrip(t *testing.T) {
+	fr := &faultRule{Path: "/slow", Drip: &drip{Bytes: 2, Interval: duration(time.Millisecond)}}
+	if err := fr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	pw := &pieceWriter{ResponseRecorder: httptest.NewRecorder()}
+	w, injected, answered := fr.apply(pw, httptest.NewRequest("GET", "/slow", nil))
+	if answered || injected == nil || !injected.Drip {
+		t.Fatalf("got %+v answered: %v, want a drip that leaves the response to the path", injected, answered)
+	}
+	w.Write([]byte("abcde"))
+	if len(pw.pieces) != 3 || pw.pieces[0] != "ab" || pw.pieces[2] != "e" || !pw.Flushed {
+		t.Errorf("got pieces %q flushed: %v, want the body flushed 2 bytes at a time", pw.pieces, pw.Flushed)
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	if err := env.faults.set(&faultRule{Path: "/flaky", Connection: faultReset}); err != nil {
+		t.Fatal(err)
+	}
+	srv, completed := captureServer(t, env, "/flaky")
+	if resp, err := http.Get(srv.URL + "/flaky"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("got status %d, want the connection reset", resp.StatusCode)
+	}
+	// the request is stored before the connection goes
+	cr := waitCompleted(t, completed)
+	if cr.Fault == nil || cr.Fault.Connection != faultReset || cr.Response != nil {
+		t.Errorf("got fault %+v and response %+v, want a reset without a response", cr.Fault, cr.Response)
+	}
+}
+
+func TestFaultStatusAfterLatency(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	err := env.faults.set(&faultRule{Path: "/down/*", Status: http.StatusServiceUnavailable, Body: "down",
+		Latency: &latency{Fixed: duration(20 * time.Millisecond)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, completed := captureServer(t, env, "/down/x")
+	resp, err := http.Get(srv.URL + "/down/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "down" {
+		t.Errorf("got %d %q, want the fault status", resp.StatusCode, body)
+	}
+	if f := waitCompleted(t, completed).Fault; f == nil || f.Status != http.StatusServiceUnavailable || f.Latency != 20*time.Millisecond {
+		t.Errorf("got fault %+v, want the status after 20ms", f)
+	}
+}
+
+func TestFaultSelection(t *testing.T) {
+	fr := &faultRule{Path: "/x", Status: 500, Requests: []int{2}, Every: 3}
+	if err := fr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	var failed []int
+	for n := 1; n <= 6; n++ {
+		if fr.fails() {
+			failed = append(failed, n)
+		}
+	}
+	if len(failed) != 3 || failed[0] != 2 || failed[1] != 3 || failed[2] != 6 {
+		t.Errorf("requests %v failed, want 2, 3 and 6", failed)
+	}
+}
@@ -1,9 +1,12 @@
 package internal
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -13,22 +16,112 @@ import (
 )
 
 var pathmap = sync.Map{}
-var dataStore = newMemStore()
+var trapEnv *captureEnv
+
+// captureEnv is the state shared by the capture handlers and the query server
+type captureEnv struct {
+	store     storage
+	notifier  *captureNotifier
+	broker    *broker
+	responses *responseRules
+	bins      *binRegistry
+	proxies   *proxyRules
+	faults    *faultRules
+	protos    *protoRegistry // descriptors captured grpc messages are decoded with
+	echo      bool           // reply to requests without a response or upstream with the request itself
+	maxBody   int64          // how much of a request body is kept, the rest is passed on without being held
+
+	capturePort    string
+	tlsCapturePort string
+	ca             *certAuthority // set when flytrap generates the capture port certificates
+	clientCAs      *x509.CertPool // verifies the client certificates presented on the tls capture port
+}
+
+func newCaptureEnv(store storage, capturePort string) *captureEnv {
+	return &captureEnv{
+		store:       store,
+		notifier:    newCaptureNotifier(),
+		broker:      newBroker(),
+		responses:   newResponseRules(),
+		bins:        newBinRegistry(),
+		proxies:     newProxyRules(),
+		faults:      newFaultRules(),
+		protos:      newProtoRegistry(),
+		maxBody:     maxRecordedBody,
+		capturePort: capturePort,
+	}
+}
+
+// capture stores a request and lets waiting and streaming clients know about it.
+// Requests of a bin that was deleted while they were read are dropped.
+func (e *captureEnv) capture(path string, cr *CapturedRequest) {
+	if !e.bins.whileExists(path, func() { e.store.append(path, cr) }) {
+		return
+	}
+	e.notifier.notify()
+	e.broker.publish(eventRequest, path, cr)
+}
+
+// progress shows the live tail a request again while a websocket opened by it is still running.
+// It is not stored again until complete: every frame so far goes with it, so storing it on each frame
+// would write the conversation over and over.
+func (e *captureEnv) progress(path string, cr *CapturedRequest) {
+	e.broker.publish(eventWebSocket, path, cr)
+}
+
+// complete stores a request again once flytrap is done replying to it, with the response filled in
+func (e *captureEnv) complete(path string, cr *CapturedRequest) {
+	if !e.bins.whileExists(path, func() { e.store.update(path, cr) }) {
+		return
+	}
+	e.notifier.notify()
+	e.broker.publish(eventResponse, path, cr)
+}
+
+// Config holds the flytrap settings
+type Config struct {
+	CapturePort     string
+	QueryPort       string
+	TTL             time.Duration
+	Expiry          string   // ExpiryPath or ExpiryRequest, how TTL is applied
+	ResponsesFile   string   // json file with the mock responses to install at startup
+	Proxies         []string // upstreams to forward captured requests to, see parseProxyRule
+	GRPCDescriptors []string // FileDescriptorSet files to decode grpc messages with
+	Echo            bool     // reply with the request as json by default, instead of an empty 200
+	Store           string   // storage backend, StoreMemory or StoreDisk
+	DataDir         string   // where the disk store keeps its data, and the generated CA of the tls capture port
+	Limits          RetentionLimits
+
+	TLSCapturePort string // serves the capture handlers over https too, when set
+	TLSCert        string // cert and key files for the tls capture port, a CA is generated if they are not given
+	TLSKey         string
+	TLSClientAuth  string // ClientAuthNone, ClientAuthRequest or ClientAuthRequire
+	TLSClientCA    string // CA bundle client certificates are verified against
+}
 
 type templateData struct {
-	CapturePort string
-	HandlerTTL  string
-	HandlerData []handlerData
+	CapturePort    string
+	TLSCapturePort string
+	HandlerTTL     string
+	ExpiryMode     string
+	Bin            *apiBin // set when the page shows a single bin
+	HandlerData    []handlerData
 }
 
-var tdata = templateData{HandlerTTL: getHandlerTTL().String()}
+var tdata = templateData{}
 
 type handlerData struct {
 	Path string
-	Reqs [][]string
+	Reqs []requestData
+}
+
+type requestData struct {
+	ID    string
+	Lines []string
 }
 
-func getHandlerTTL() time.Duration {
+// HandlerTTLFromEnv reads the TTL from the HANDLER_TTL env var, falling back to DefaultHandlerTTL
+func HandlerTTLFromEnv() time.Duration {
 	ttl := os.Getenv("HANDLER_TTL")
 	if ttl != "" {
 		ttlDur, err := time.ParseDuration(ttl)
@@ -47,13 +140,17 @@ func getHandlerTTL() time.Duration {
 // dynamicHandler dynamically creates handlers for paths that it sees for the first time
 func dynamicHandler(writer http.ResponseWriter, request *http.Request) {
 	path := request.URL.Path
+	// bins have to be created through the api before they capture anything
+	if id, ok := binID(path); ok && !trapEnv.bins.touch(id) {
+		http.Error(writer, "flytrap: no bin with id: "+id, http.StatusNotFound)
+		return
+	}
 	h, ok := pathmap.Load(path)
-	// new path detected
+	// new path detected, if another request raced us to it use the handler it installed
 	if !ok {
-		h = newexpiringHandler(path, dataStore)
-		pathmap.Store(path, h)
+		h, _ = pathmap.LoadOrStore(path, newexpiringHandler(path, trapEnv))
 	}
-	handler := h.(expiringHandler)
+	handler := h.(*expiringHandler)
 	handler.ServeHTTP(writer, request)
 }
 
@@ -94,47 +191,204 @@ func serveTemplate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// copy the shared template data, the page may be rendered concurrently
+	td := tdata
+	prefix := ""
+	if id := r.URL.Query().Get("bin"); id != "" {
+		b, ok := trapEnv.bins.get(id)
+		if !ok {
+			http.Error(w, "no bin with id: "+id, http.StatusNotFound)
+			return
+		}
+		ab := newAPIBin(r, trapEnv, b)
+		td.Bin = &ab
+		prefix = b.prefix()
+	}
+
 	data := []handlerData{}
-	dataStore.foreach(func(key string, values []interface{}) bool {
+	trapEnv.store.foreach(func(key string, values []*CapturedRequest) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
 		d := handlerData{}
 		d.Path = key
 		for _, v := range values {
-			// restore the body for future reads
-			displayVal := fmt.Sprintf("Request: %s", v)
+			displayVal := fmt.Sprintf("Request: %s received: %s from: %s\n%s",
+				v.ID, v.ReceivedAt.Format(time.StampMilli), v.RemoteAddr, v.Dump())
+			if v.StreamID != 0 {
+				displayVal += fmt.Sprintf("\n%s stream: %d", v.Proto, v.StreamID)
+			}
+			if t := v.TLS; t != nil {
+				displayVal += fmt.Sprintf("\nTLS: %s %s server name: %s protocol: %s", t.Version, t.CipherSuite, t.ServerName, t.NegotiatedProtocol)
+				for _, c := range t.ClientCertificates {
+					displayVal += fmt.Sprintf("\nClient certificate: %s issuer: %s serial: %s sha256: %s valid: %s - %s",
+						c.Subject, c.Issuer, c.SerialNumber, c.SHA256Fingerprint, c.NotBefore.Format(time.DateOnly), c.NotAfter.Format(time.DateOnly))
+				}
+				if t.ClientVerified {
+					displayVal += "\nClient certificate verified"
+				} else if t.ClientVerifyError != "" {
+					displayVal += "\nClient certificate not verified: " + t.ClientVerifyError
+				}
+			}
+			if resp := v.Response; resp != nil {
+				displayVal += fmt.Sprintf("\n\nResponse: in %v\n%s", resp.Latency, resp.Dump())
+				if resp.Disconnected {
+					displayVal += "\nClient disconnected before the response ended"
+					if resp.DisconnectedAt != nil {
+						displayVal += " at " + resp.DisconnectedAt.Format(time.StampMilli)
+					}
+				}
+				if resp.Delivered > 0 {
+					displayVal += fmt.Sprintf("\nStreamed %d events or chunks", resp.Delivered)
+				}
+			}
+			if f := v.Fault; f != nil {
+				displayVal += "\nFault: " + f.String()
+			}
+			if call := v.GRPC; call != nil {
+				displayVal += "\n\n" + call.String()
+			}
+			if ws := v.WebSocket; ws != nil {
+				displayVal += "\n\nWebSocket:"
+				for _, f := range ws.Frames {
+					displayVal += "\n" + f.String()
+				}
+				if ws.FramesDropped > 0 {
+					displayVal += fmt.Sprintf("\n... %d more frames not recorded", ws.FramesDropped)
+				}
+				if ws.ClosedAt != nil {
+					displayVal += "\nClosed: " + ws.ClosedAt.Format(time.StampMilli)
+				}
+			}
+			if up := v.Upstream; up != nil {
+				displayVal += fmt.Sprintf("\n\nForwarded to: %s in: %v\n", up.URL, up.Duration)
+				if up.Error != "" {
+					displayVal += "Upstream error: " + up.Error
+				} else if up.Response != nil {
+					displayVal += string(up.Response.Dump())
+				}
+			}
 			// for better formatting
 			lines := strings.Split(displayVal, "\n")
-			d.Reqs = append(d.Reqs, lines)
+			d.Reqs = append(d.Reqs, requestData{ID: v.ID, Lines: lines})
 		}
 		data = append(data, d)
 		return true
 	})
-	tdata.HandlerData = data
+	td.HandlerData = data
 
-	if err := tmpl.ExecuteTemplate(w, "layout", tdata); err != nil {
+	if err := tmpl.ExecuteTemplate(w, "layout", td); err != nil {
 		log.Println(err.Error())
 		http.Error(w, http.StatusText(500), 500)
 	}
 }
 
 // Trap starts the flytrap capture
-func Trap(capturePort, queryPort string, ttl time.Duration) {
-	// set capture port for template
-	tdata.CapturePort = capturePort
-	go pruneHandlers(ttl, &pathmap)
+func Trap(cfg Config) {
+	store, err := newStorage(cfg.Store, cfg.DataDir)
+	if err != nil {
+		log.Fatalf("Error opening store: %v", err)
+	}
+	trapEnv = newCaptureEnv(withRetention(store, cfg.Limits), cfg.CapturePort)
+	if cfg.Limits.MaxBodyBytes > 0 {
+		trapEnv.maxBody = cfg.Limits.MaxBodyBytes
+	}
+	if ds, ok := store.(*diskStore); ok {
+		// bins outlive restarts with the requests they captured
+		if trapEnv.bins, err = openBinRegistry(filepath.Join(ds.dir, binsFile)); err != nil {
+			log.Fatalf("Error opening store: %v", err)
+		}
+	}
+	restoreHandlers(trapEnv, &pathmap)
+
+	if cfg.ResponsesFile != "" {
+		if err := trapEnv.responses.loadFile(cfg.ResponsesFile); err != nil {
+			log.Fatalf("Error loading responses: %v", err)
+		}
+	}
+
+	for _, p := range cfg.Proxies {
+		pr, err := parseProxyRule(p)
+		if err == nil {
+			err = trapEnv.proxies.set(pr)
+		}
+		if err != nil {
+			log.Fatalf("Error configuring proxy: %v", err)
+		}
+		log.Printf("Forwarding requests under %s to %s", pr.Prefix, pr.Upstream)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCapturePort != "" {
+		var ca *certAuthority
+		if tlsConfig, ca, err = newCaptureTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.DataDir); err != nil {
+			log.Fatalf("Error configuring tls capture: %v", err)
+		}
+		if trapEnv.clientCAs, err = configureClientAuth(tlsConfig, cfg.TLSClientAuth, cfg.TLSClientCA); err != nil {
+			log.Fatalf("Error configuring tls client auth: %v", err)
+		}
+		trapEnv.tlsCapturePort, trapEnv.ca = cfg.TLSCapturePort, ca
+	}
+
+	trapEnv.echo = cfg.Echo
+
+	for _, d := range cfg.GRPCDescriptors {
+		if err := trapEnv.protos.loadFile(d); err != nil {
+			log.Fatalf("Error loading grpc descriptors: %v", err)
+		}
+	}
+
+	if cfg.TTL <= 0 {
+		cfg.TTL = HandlerTTLFromEnv()
+	}
+	switch cfg.Expiry {
+	case "":
+		cfg.Expiry = ExpiryPath
+	case ExpiryPath, ExpiryRequest:
+	default:
+		log.Fatalf("Unknown expiry mode: %s (use %s or %s)", cfg.Expiry, ExpiryPath, ExpiryRequest)
+	}
+
+	// set capture port and expiry for template
+	tdata.CapturePort = cfg.CapturePort
+	tdata.TLSCapturePort = cfg.TLSCapturePort
+	tdata.HandlerTTL = cfg.TTL.String()
+	tdata.ExpiryMode = cfg.Expiry
+	go pruneHandlers(cfg.TTL, cfg.Expiry, &pathmap, trapEnv)
 
 	// query server
-	log.Printf("Starting query server on port %s", queryPort)
+	log.Printf("Starting query server on port %s", cfg.QueryPort)
 	fs := http.FileServer(http.Dir("static"))
 	querySrv := http.NewServeMux()
 	// querySrv.Handle("/", createQueryHandler(fs))
 	querySrv.Handle("/", createQueryHandler(http.StripPrefix("/static/", fs)))
+	querySrv.Handle("/api/", createAPIHandler(trapEnv))
 	go func() {
-		log.Printf("Query server exiting with error: %s", http.ListenAndServe(":"+queryPort, querySrv).Error())
+		log.Printf("Query server exiting with error: %s", http.ListenAndServe(":"+cfg.QueryPort, querySrv).Error())
 	}()
 
 	// capture server
-	log.Printf("Laying trap on port %s", capturePort)
+	log.Printf("Laying trap on port %s", cfg.CapturePort)
 	captureSrv := http.NewServeMux()
 	captureSrv.Handle("/", http.HandlerFunc(dynamicHandler))
-	log.Printf("Capture server exiting with error: %s", http.ListenAndServe(":"+capturePort, captureSrv).Error())
+	// HTTP/2 connections, over tls or cleartext, are handed to a server of their own
+	h2 := newH2Server(captureSrv)
+	if tlsConfig != nil {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		tlsSrv := &http.Server{
+			Addr:         ":" + cfg.TLSCapturePort,
+			Handler:      captureSrv,
+			TLSConfig:    tlsConfig,
+			TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){"h2": h2.serveTLS},
+		}
+		go func() {
+			log.Printf("Laying tls trap on port %s", cfg.TLSCapturePort)
+			log.Printf("TLS capture server exiting with error: %s", tlsSrv.ListenAndServeTLS("", "").Error())
+		}()
+	}
+	ln, err := net.Listen("tcp", ":"+cfg.CapturePort)
+	if err != nil {
+		log.Fatalf("Error listening on capture port: %v", err)
+	}
+	log.Printf("Capture server exiting with error: %s", http.Serve(h2.listen(ln), h2.upgrade(captureSrv)).Error())
 }
@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPCCall is a gRPC call captured on a path, with the messages sent in each direction decoded to json
+type GRPCCall struct {
+	Service       string        `json:"service"`
+	Method        string        `json:"method"`
+	Requests      []GRPCMessage `json:"requests"`
+	Responses     []GRPCMessage `json:"responses,omitempty"`
+	Status        *int          `json:"status,omitempty"` // the grpc status code the call ended with
+	StatusMessage string        `json:"statusMessage,omitempty"`
+	Error         string        `json:"error,omitempty"` // why the request messages could not be read
+}
+
+// String renders the call with a line for each message, -> for requests and <- for responses
+func (call *GRPCCall) String() string {
+	s := "gRPC: " + call.Service + "/" + call.Method
+	if call.Status != nil {
+		s += fmt.Sprintf(" status: %d %s %s", *call.Status, grpcStatusName(*call.Status), call.StatusMessage)
+	}
+	if call.Error != "" {
+		s += "\nError: " + call.Error
+	}
+	for _, m := range call.Requests {
+		s += "\n-> " + m.String()
+	}
+	for _, m := range call.Responses {
+		s += "\n<- " + m.String()
+	}
+	return s
+}
+
+// GRPCMessage is a single length prefixed message. It is decoded with the descriptors of the method when they
+// were loaded, otherwise its fields are keyed by number.
+type GRPCMessage struct {
+	Compressed bool            `json:"compressed,omitempty"`
+	Size       int             `json:"size"`
+	Type       string          `json:"type,omitempty"` // the message type it was decoded as
+	JSON       json.RawMessage `json:"json,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+func (m GRPCMessage) String() string {
+	if m.Error != "" {
+		return fmt.Sprintf("(%d bytes) error: %s", m.Size, m.Error)
+	}
+	return string(m.JSON)
+}
+
+// grpcStatusNames are the names of the grpc status codes
+var grpcStatusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+	"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE",
+	"UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+func grpcStatusName(code int) string {
+	if code >= 0 && code < len(grpcStatusNames) {
+		return grpcStatusNames[code]
+	}
+	return strconv.Itoa(code)
+}
+
+func isGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// grpcMethod splits the service and method out of a capture path, /pkg.Service/Method,
+// the last two segments are used so calls captured in a bin are recognised too
+func grpcMethod(path string) (string, string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 {
+		return "", path
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+// newGRPCCall reads the request messages out of a captured grpc request
+func newGRPCCall(cr *CapturedRequest, reg *protoRegistry) *GRPCCall {
+	call := &GRPCCall{Requests: []GRPCMessage{}}
+	call.Service, call.Method = grpcMethod(cr.Path)
+	inputType := ""
+	if md, ok := reg.methods[call.Service+"/"+call.Method]; ok {
+		inputType = md.input
+	}
+	var err error
+	call.Requests, err = readGRPCMessages(cr.Body, cr.Header.Get("Grpc-Encoding"), inputType, reg)
+	if err != nil {
+		call.Error = err.Error()
+	}
+	return call
+}
+
+// truncated returns a copy of the call without the decoded messages that are over max bytes,
+// or the call itself if they all fit
+func (call *GRPCCall) truncated(max int64) *GRPCCall {
+	if call == nil {
+		return nil
+	}
+	drop := func(msgs []GRPCMessage) ([]GRPCMessage, bool) {
+		var t []GRPCMessage
+		for i, m := range msgs {
+			if int64(len(m.JSON)) <= max {
+				continue
+			}
+			if t == nil {
+				t = append([]GRPCMessage(nil), msgs...)
+			}
+			t[i].JSON = nil
+			t[i].Error = fmt.Sprintf("decoded message of %d bytes is over the body limit", len(m.JSON))
+		}
+		if t == nil {
+			return msgs, false
+		}
+		return t, true
+	}
+	reqs, reqsChanged := drop(call.Requests)
+	resps, respsChanged := drop(call.Responses)
+	if !reqsChanged && !respsChanged {
+		return call
+	}
+	t := *call
+	t.Requests, t.Responses = reqs, resps
+	return &t
+}
+
+// completed returns a copy of the call with the response that was sent for it
+func (call *GRPCCall) completed(resp *CapturedResponse, reg *protoRegistry) *GRPCCall {
+	done := *call
+	if resp == nil {
+		return &done
+	}
+	outputType := ""
+	if md, ok := reg.methods[call.Service+"/"+call.Method]; ok {
+		outputType = md.output
+	}
+	// messages that can't be read are kept with their error, the response body may have been cut short
+	done.Responses, _ = readGRPCMessages(resp.Body, resp.Header.Get("Grpc-Encoding"), outputType, reg)
+	// the status is in the trailers, or in the headers of a response without messages
+	status := resp.Trailer
+	if status.Get("Grpc-Status") == "" {
+		status = resp.Header
+	}
+	if code, err := strconv.Atoi(status.Get("Grpc-Status")); err == nil {
+		done.Status = &code
+		done.StatusMessage = decodeGRPCMessage(status.Get("Grpc-Message"))
+	}
+	return &done
+}
+
+// maxGRPCDecoded is how many message bytes of a call are decoded in each direction, the rest are only listed
+const maxGRPCDecoded = 4 << 20
+
+// readGRPCMessages splits a grpc body into its length prefixed messages and decodes them
+func readGRPCMessages(body []byte, encoding, typeName string, reg *protoRegistry) ([]GRPCMessage, error) {
+	msgs := []GRPCMessage{}
+	decoded := 0
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return msgs, fmt.Errorf("grpc: %d bytes left after the last message", len(body))
+		}
+		m := GRPCMessage{Compressed: body[0] == 1, Size: int(binary.BigEndian.Uint32(body[1:5]))}
+		if len(body)-5 < m.Size {
+			m.Error = fmt.Sprintf("message of %d bytes is cut short at %d bytes", m.Size, len(body)-5)
+			return append(msgs, m), fmt.Errorf("grpc: %s", m.Error)
+		}
+		data := body[5 : 5+m.Size]
+		body = body[5+m.Size:]
+		if m.Compressed {
+			var err error
+			if data, err = decompressGRPC(data, encoding); err != nil {
+				m.Error = err.Error()
+				msgs = append(msgs, m)
+				continue
+			}
+		}
+		if decoded += len(data); decoded > maxGRPCDecoded {
+			m.Error = fmt.Sprintf("not decoded, the call is over the %d byte decode limit", maxGRPCDecoded)
+			msgs = append(msgs, m)
+			continue
+		}
+		m.decode(data, typeName, reg)
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func decompressGRPC(data []byte, encoding string) ([]byte, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("grpc: can't decompress %q messages", encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(zr, maxRecordedBody))
+}
+
+func (m *GRPCMessage) decode(data []byte, typeName string, reg *protoRegistry) {
+	if typeName != "" {
+		m.Type = typeName
+		var err error
+		if m.JSON, err = reg.decode(typeName, data); err != nil {
+			m.Error = err.Error()
+		}
+		return
+	}
+	v, err := decodeSchemaless(data, 1)
+	if err != nil {
+		m.Error = err.Error()
+		return
+	}
+	m.JSON, _ = json.Marshal(v)
+}
+
+// grpcReply is how a grpc call on a path is answered, configured with the mock response of the path.
+// Without it calls get a single empty message, which every message type reads as its defaults, and an OK status.
+type grpcReply struct {
+	Code     int               `json:"code,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Messages [][]byte          `json:"messages,omitempty"` // encoded protobuf messages, base64 in json
+	Metadata map[string]string `json:"metadata,omitempty"` // sent as response headers
+	Trailers map[string]string `json:"trailers,omitempty"`
+}
+
+// write sends the reply, a call that fails without messages gets its status in the headers (trailers only)
+func (gr *grpcReply) write(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	for name, value := range gr.Metadata {
+		h.Set(name, value)
+	}
+	msgs := gr.Messages
+	if msgs == nil && gr.Code == 0 {
+		msgs = [][]byte{{}}
+	}
+	trailer := func(name, value string) {
+		if len(msgs) > 0 {
+			name = http.TrailerPrefix + name
+		}
+		h.Set(name, value)
+	}
+	if len(msgs) == 0 {
+		gr.writeStatus(trailer)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	for _, m := range msgs {
+		prefix := make([]byte, 5)
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(m)))
+		w.Write(append(prefix, m...))
+	}
+	gr.writeStatus(trailer)
+}
+
+func (gr *grpcReply) writeStatus(trailer func(name, value string)) {
+	trailer("Grpc-Status", strconv.Itoa(gr.Code))
+	if gr.Message != "" {
+		trailer("Grpc-Message", encodeGRPCMessage(gr.Message))
+	}
+	for name, value := range gr.Trailers {
+		trailer(name, value)
+	}
+}
+
+// encodeGRPCMessage percent encodes a status message the way the grpc spec asks
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func decodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if c, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,430 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http2Preface is what every HTTP/2 client sends first
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types and flags flytrap needs to look at
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	frameSettings     = 0x4
+	frameContinuation = 0x9
+
+	flagEndStream  = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+)
+
+// h2MaxFrameSize is the largest frame the HTTP/2 server accepts, it is also the limit for frames
+// that grow when the stream id is added to them. Connections sending larger frames are closed before they are read.
+const h2MaxFrameSize = 1 << 20
+
+// sniffTimeout is how long a client of the cleartext capture port has to send its first bytes
+const sniffTimeout = 10 * time.Second
+
+// maxUpgradeBody is the largest body an h2c upgrade request can have, it has to fit in the initial flow control window.
+// Larger requests are served over HTTP/1.1, which the client has to accept.
+const maxUpgradeBody = 65535
+
+// streamIDHeader carries the stream id of a request from the connection to the handler.
+// The net/http HTTP/2 server does not expose stream ids, so it is added to the header block of each new stream.
+// Its value is the id followed by the key of the connection, copies a client sent itself don't have the key.
+const streamIDHeader = "flytrap-stream-id"
+
+type h2ConnKey struct{}
+type streamIDKey struct{}
+
+// h2Server serves the HTTP/2 connections of the capture servers, whether they arrived over tls,
+// as cleartext h2c with prior knowledge, or were upgraded from HTTP/1.1.
+// It is the net.Listener of its own http.Server, the capture servers hand their HTTP/2 connections to it.
+type h2Server struct {
+	srv          *http.Server
+	conns        chan net.Conn
+	sniffTimeout time.Duration
+}
+
+func newH2Server(handler http.Handler) *h2Server {
+	s := &h2Server{conns: make(chan net.Conn), sniffTimeout: sniffTimeout}
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	s.srv = &http.Server{
+		Handler:   s.handler(handler),
+		Protocols: protocols,
+		HTTP2:     &http.HTTP2Config{MaxReadFrameSize: h2MaxFrameSize},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, h2ConnKey{}, c)
+		},
+	}
+	go func() {
+		log.Printf("HTTP/2 capture server exiting with error: %s", s.srv.Serve(s).Error())
+	}()
+	return s
+}
+
+func (s *h2Server) Accept() (net.Conn, error) {
+	return <-s.conns, nil
+}
+
+func (s *h2Server) Close() error {
+	return nil
+}
+
+func (s *h2Server) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// serveTLS is the TLSNextProto handler for h2, the connection is closed once it returns so it waits for the
+// HTTP/2 server to be done with it
+func (s *h2Server) serveTLS(_ *http.Server, c *tls.Conn, _ http.Handler) {
+	state := c.ConnectionState()
+	hc := newH2Conn(c, bufio.NewReader(c), &state)
+	s.conns <- hc
+	<-hc.done
+}
+
+// handler restores what the HTTP/2 server doesn't pass on from the connection: the tls state and the stream id
+func (s *h2Server) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		hc, _ := ctx.Value(h2ConnKey{}).(*h2Conn)
+		if hc != nil && hc.tls != nil {
+			r.TLS = hc.tls
+		}
+		values := r.Header.Values(streamIDHeader)
+		r.Header.Del(streamIDHeader)
+		if hc != nil {
+			if id, ok := hc.streamID(values); ok {
+				ctx = context.WithValue(ctx, streamIDKey{}, id)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// streamID returns the HTTP/2 stream id a request arrived on, 0 for HTTP/1
+func streamID(r *http.Request) uint32 {
+	id, _ := r.Context().Value(streamIDKey{}).(uint32)
+	return id
+}
+
+// listen splits a cleartext listener, connections that start with the HTTP/2 preface (h2c with prior knowledge)
+// go to the HTTP/2 server, the rest are returned by the listener for an HTTP/1.1 server
+func (s *h2Server) listen(ln net.Listener) net.Listener {
+	l := &h2cListener{Listener: ln, h2: s, conns: make(chan net.Conn), errs: make(chan error)}
+	go l.run()
+	return l
+}
+
+type h2cListener struct {
+	net.Listener
+	h2    *h2Server
+	conns chan net.Conn
+	errs  chan error
+}
+
+func (l *h2cListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.sniff(c)
+	}
+}
+
+// sniff reads as much of the preface as the client sent before it differs, clients always speak first.
+// Clients that say nothing for sniffTimeout are disconnected.
+func (l *h2cListener) sniff(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(l.h2.sniffTimeout))
+	br := bufio.NewReader(c)
+	for i := 1; i <= len(http2Preface); i++ {
+		b, err := br.Peek(i)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.Close()
+			return
+		}
+		if err != nil || b[i-1] != http2Preface[i-1] {
+			c.SetReadDeadline(time.Time{})
+			l.conns <- &bufferedConn{Conn: c, r: br}
+			return
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	l.h2.conns <- newH2Conn(c, br, nil)
+}
+
+func (l *h2cListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+// bufferedConn is a connection some of which has already been read into r
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// upgrade switches HTTP/1.1 requests that ask for it to h2c, the request is then answered over HTTP/2 as stream 1.
+// Requests with invalid HTTP2-Settings are served over HTTP/1.1.
+func (s *h2Server) upgrade(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 || !headerHasToken(r.Header, "Upgrade", "h2c") ||
+			!headerHasToken(r.Header, "Connection", "HTTP2-Settings") || r.Header.Get("HTTP2-Settings") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.Header.Get("HTTP2-Settings"), "="))
+		if err != nil || len(settings)%6 != 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxUpgradeBody+1))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if err != nil || len(body) > maxUpgradeBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+			conn.Close()
+			return
+		}
+		hc := newH2Conn(conn, brw.Reader, nil)
+		// the settings the client sent in the header come first, as if it had sent them in a SETTINGS frame
+		hc.inject = append(appendFrame(nil, frameSettings, 0, 0, settings), upgradeFrames(r, body, hc.streamIDValue(1))...)
+		s.conns <- hc
+	})
+}
+
+// hopHeaders only apply to the HTTP/1.1 connection an h2c request was upgraded from
+var hopHeaders = []string{"Connection", "Upgrade", "Http2-Settings", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Te"}
+
+// upgradeFrames encodes an upgraded request as the frames a client would have sent for it on stream 1,
+// streamID is the value of the stream id field
+func upgradeFrames(r *http.Request, body []byte, streamID string) []byte {
+	block := hpackField(nil, ":method", r.Method)
+	block = hpackField(block, ":scheme", "http")
+	block = hpackField(block, ":authority", r.Host)
+	block = hpackField(block, ":path", r.RequestURI)
+	for name, values := range r.Header {
+		if containsFold(hopHeaders, name) {
+			continue
+		}
+		for _, v := range values {
+			block = hpackField(block, strings.ToLower(name), v)
+		}
+	}
+	block = hpackField(block, streamIDHeader, streamID)
+
+	var frames []byte
+	if len(body) == 0 {
+		return appendFrame(frames, frameHeaders, flagEndHeaders|flagEndStream, 1, block)
+	}
+	frames = appendFrame(frames, frameHeaders, flagEndHeaders, 1, block)
+	for len(body) > 0 {
+		n := min(len(body), 16384)
+		var flags byte
+		if n == len(body) {
+			flags = flagEndStream
+		}
+		frames = appendFrame(frames, frameData, flags, 1, body[:n])
+		body = body[n:]
+	}
+	return frames
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendFrame(b []byte, typ, flags byte, stream uint32, payload []byte) []byte {
+	b = append(b, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), typ, flags)
+	b = binary.BigEndian.AppendUint32(b, stream)
+	return append(b, payload...)
+}
+
+// hpackField appends a literal header field without indexing, it leaves the decoder's dynamic table alone
+// so it can be added to a header block without disturbing the fields around it
+func hpackField(b []byte, name, value string) []byte {
+	b = append(b, 0)
+	b = hpackString(b, name)
+	return hpackString(b, value)
+}
+
+func hpackString(b []byte, s string) []byte {
+	b = hpackInt(b, 7, uint64(len(s)))
+	return append(b, s...)
+}
+
+func hpackInt(b []byte, prefix uint, i uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if i < max {
+		return append(b, byte(i))
+	}
+	b = append(b, byte(max))
+	for i -= max; i >= 128; i >>= 7 {
+		b = append(b, byte(i)|0x80)
+	}
+	return append(b, byte(i))
+}
+
+// h2Conn reads the frames a client sends and adds the stream id to the header block of every new stream
+type h2Conn struct {
+	net.Conn
+	src    *bufio.Reader
+	tls    *tls.ConnectionState
+	inject []byte // frames to add after the preface, for a request that was upgraded
+	key    string // tells the stream ids added here from the ones a client sends
+
+	out        bytes.Buffer // the rest of the last frame read, what Read returns next
+	prefaced   bool
+	lastStream uint32 // client streams are opened in increasing order, a HEADERS frame above this opens one
+	pending    uint32 // a new stream whose header block continues in CONTINUATION frames
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newH2Conn(c net.Conn, src *bufio.Reader, state *tls.ConnectionState) *h2Conn {
+	return &h2Conn{Conn: c, src: src, tls: state, key: rand.Text(), done: make(chan struct{})}
+}
+
+// streamIDValue is the value of the stream id field added to the header block of a stream
+func (c *h2Conn) streamIDValue(stream uint32) string {
+	return fmt.Sprintf("%d %s", stream, c.key)
+}
+
+// streamID finds the stream id this connection added among the values of the stream id field
+func (c *h2Conn) streamID(values []string) (uint32, bool) {
+	for _, v := range values {
+		id, key, ok := strings.Cut(v, " ")
+		if !ok || key != c.key {
+			continue
+		}
+		if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+			return uint32(n), true
+		}
+	}
+	return 0, false
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	for c.out.Len() == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	return c.out.Read(b)
+}
+
+func (c *h2Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// next reads the preface or the next frame into out
+func (c *h2Conn) next() error {
+	if !c.prefaced {
+		if _, err := io.CopyN(&c.out, c.src, int64(len(http2Preface))); err != nil {
+			return err
+		}
+		c.prefaced = true
+		if c.inject != nil {
+			c.out.Write(c.inject)
+			c.inject = nil
+			c.lastStream = 1
+		}
+		return nil
+	}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(c.src, header); err != nil {
+		return err
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	if length > h2MaxFrameSize {
+		c.Close()
+		return fmt.Errorf("HTTP/2 frame of %d bytes is over the %d byte limit", length, h2MaxFrameSize)
+	}
+	typ, flags := header[3], header[4]
+	stream := binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.src, payload); err != nil {
+		return err
+	}
+
+	switch {
+	case typ == frameHeaders && stream > c.lastStream:
+		c.lastStream = stream
+		if flags&flagEndHeaders == 0 {
+			c.pending = stream
+			break
+		}
+		payload = c.addStreamID(payload, flags, stream)
+	case typ == frameContinuation && stream == c.pending && flags&flagEndHeaders != 0:
+		c.pending = 0
+		payload = c.addStreamID(payload, 0, stream)
+	}
+	c.out.Write(appendFrame(header[:0], typ, flags, stream, payload))
+	return nil
+}
+
+// addStreamID appends the stream id field to the end of a header block fragment, before any padding
+func (c *h2Conn) addStreamID(payload []byte, flags byte, stream uint32) []byte {
+	field := hpackField(nil, streamIDHeader, c.streamIDValue(stream))
+	if len(payload)+len(field) > h2MaxFrameSize {
+		return payload
+	}
+	end := len(payload)
+	if flags&flagPadded != 0 && len(payload) > 0 {
+		end -= int(payload[0])
+	}
+	if end < 0 {
+		return payload
+	}
+	grown := make([]byte, 0, len(payload)+len(field))
+	grown = append(grown, payload[:end]...)
+	grown = append(grown, field...)
+	return append(grown, payload[end:]...)
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// seenRequest is what the capture handler got from the HTTP/2 server
+type seenRequest struct {
+	proto, path, body, trailer string
+	stream                     uint32
+	header                     []string // what is left of the stream id field
+}
+
+// h2Listener serves the capture ports the way Trap does and hands over each request the handler saw
+func h2Listener(t *testing.T) (net.Addr, chan seenRequest) {
+	handler, seen := seenHandler()
+	return serveH2(t, newH2Server(handler), handler), seen
+}
+
+// seenHandler hands over what it got and replies with the body
+func seenHandler() (http.Handler, chan seenRequest) {
+	seen := make(chan seenRequest, 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- seenRequest{proto: r.Proto, path: r.URL.Path, body: string(body), trailer: r.Trailer.Get("X-Checksum"),
+			stream: streamID(r), header: r.Header.Values(streamIDHeader)}
+		w.Write(body)
+	}), seen
+}
+
+func serveH2(t *testing.T, h2 *h2Server, handler http.Handler) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go http.Serve(h2.listen(ln), h2.upgrade(handler))
+	return ln.Addr()
+}
+
+func dialH2(t *testing.T, addr net.Addr) net.Conn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// writePreface starts the HTTP/2 connection, what the server writes back isn't read
+func writePreface(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write(appendFrame([]byte(http2Preface), frameSettings, 0, 0, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads the next frame the server sent
+func readFrame(t *testing.T, r io.Reader) (typ byte, stream uint32, payload []byte) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	payload = make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	return header[3], binary.BigEndian.Uint32(header[5:]), payload
+}
+
+func requestBlock(path string, fields ...string) []byte {
+	block := hpackField(nil, ":method", "POST")
+	block = hpackField(block, ":scheme", "http")
+	block = hpackField(block, ":authority", "flytrap")
+	block = hpackField(block, ":path", path)
+	for i := 0; i < len(fields); i += 2 {
+		block = hpackField(block, fields[i], fields[i+1])
+	}
+	return block
+}
+
+func padded(block []byte, padding int) []byte {
+	b := append([]byte{byte(padding)}, block...)
+	return append(b, make([]byte, padding)...)
+}
+
+func waitSeen(t *testing.T, seen chan seenRequest) seenRequest {
+	select {
+	case r := <-seen:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request did not reach the handler")
+		return seenRequest{}
+	}
+}
+
+func TestH2StreamIDs(t *testing.T) {
+	addr, seen := h2Listener(t)
+	conn := dialH2(t, addr)
+	writePreface(t, conn)
+
+	continued := requestBlock("/continued", "x-a", "1", "x-b", "2")
+	for _, tc := range []struct {
+		name   string
+		stream uint32
+		frames []byte
+		body   string
+		trail  string
+	}{
+		{"headers", 1,
+			appendFrame(nil, frameHeaders, flagEndHeaders|flagEndStream, 1, requestBlock("/headers", streamIDHeader, "99")), "", ""},
+		{"padded", 3,
+			appendFrame(nil, frameHeaders, flagEndHeaders|flagEndStream|flagPadded, 3, padded(requestBlock("/padded"), 7)), "", ""},
+		{"continuation", 5,
+			appendFrame(appendFrame(nil, frameHeaders, flagEndStream, 5, continued[:10]),
+				frameContinuation, flagEndHeaders, 5, continued[10:]), "", ""},
+		{"padded continuation", 7,
+			appendFrame(appendFrame(nil, frameHeaders, flagEndStream|flagPadded, 7, padded(continued[:10], 3)),
+				frameContinuation, flagEndHeaders, 7, continued[10:]), "", ""},
+		// the trailers are a second HEADERS frame on the stream, no stream id is added to them
+		{"trailers", 9,
+			appendFrame(appendFrame(appendFrame(nil,
+				frameHeaders, flagEndHeaders, 9, requestBlock("/trailers", "trailer", "x-checksum")),
+				frameData, 0, 9, []byte("hello")),
+				frameHeaders, flagEndHeaders|flagEndStream, 9, hpackField(nil, "x-checksum", "abc")), "hello", "abc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := conn.Write(tc.frames); err != nil {
+				t.Fatal(err)
+			}
+			r := waitSeen(t, seen)
+			if r.proto != "HTTP/2.0" || r.stream != tc.stream {
+				t.Errorf("got %s stream %d, want HTTP/2.0 stream %d", r.proto, r.stream, tc.stream)
+			}
+			if len(r.header) != 0 {
+				t.Errorf("the handler sees the stream id field %q", r.header)
+			}
+			if r.body != tc.body || r.trailer != tc.trail {
+				t.Errorf("got body %q and trailer %q, want %q and %q", r.body, r.trailer, tc.body, tc.trail)
+			}
+		})
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	addr, seen := h2Listener(t)
+	conn := dialH2(t, addr)
+	// the settings allow the server 2 bytes on a stream until the client says more
+	io.WriteString(conn, "POST /upgraded HTTP/1.1\r\nHost: flytrap\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: AAQAAAAC\r\nContent-Length: 5\r\n\r\nhello")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	writePreface(t, conn)
+
+	r := waitSeen(t, seen)
+	if r.proto != "HTTP/2.0" || r.stream != 1 || r.path != "/upgraded" || r.body != "hello" {
+		t.Errorf("got %s stream %d %s with body %q, want the upgraded request on stream 1", r.proto, r.stream, r.path, r.body)
+	}
+	for {
+		typ, stream, payload := readFrame(t, br)
+		if typ == frameData && stream == 1 {
+			if string(payload) != "he" {
+				t.Errorf("got %q, want the reply held to the window of 2 bytes from the upgrade settings", payload)
+			}
+			break
+		}
+	}
+
+	// the client carries on from stream 3
+	conn.Write(appendFrame(nil, frameHeaders, flagEndHeaders|flagEndStream, 3, requestBlock("/next")))
+	if r := waitSeen(t, seen); r.stream != 3 || r.path != "/next" {
+		t.Errorf("got stream %d %s, want stream 3 /next", r.stream, r.path)
+	}
+}
+
+func TestH2HandlerIgnoresClientStreamID(t *testing.T) {
+	hc := newH2Conn(nil, nil, nil)
+	var got uint32
+	h := (&h2Server{}).handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = streamID(r)
+		if v := r.Header.Values(streamIDHeader); len(v) != 0 {
+			t.Errorf("the handler sees the stream id field %q", v)
+		}
+	}))
+	for _, tc := range []struct {
+		name   string
+		values []string
+		want   uint32
+	}{
+		{"sent by the client", []string{"3", "5 guess"}, 0},
+		{"added by the connection", []string{"3", hc.streamIDValue(7)}, 7},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header[http.CanonicalHeaderKey(streamIDHeader)] = tc.values
+			h.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), h2ConnKey{}, hc)))
+			if got != tc.want {
+				t.Errorf("got stream %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestH2CUpgradeInvalidSettings(t *testing.T) {
+	addr, seen := h2Listener(t)
+	conn := dialH2(t, addr)
+	io.WriteString(conn, "GET /kept HTTP/1.1\r\nHost: flytrap\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: AAQA\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want the request served over HTTP/1.1", resp.StatusCode)
+	}
+	if r := waitSeen(t, seen); r.proto != "HTTP/1.1" || r.path != "/kept" {
+		t.Errorf("got %s %s, want HTTP/1.1 /kept", r.proto, r.path)
+	}
+}
+
+func TestH2FrameTooLarge(t *testing.T) {
+	addr, _ := h2Listener(t)
+	conn := dialH2(t, addr)
+	writePreface(t, conn)
+	// only the header of a frame over the limit, the connection is closed without waiting for the payload
+	size := 2 * h2MaxFrameSize
+	conn.Write([]byte{byte(size >> 16), byte(size >> 8), byte(size), frameData, 0, 0, 0, 0, 1})
+	_, err := io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the connection was kept open after a frame over the limit")
+	}
+}
+
+func TestH2CSniffTimeout(t *testing.T) {
+	handler, _ := seenHandler()
+	h2 := newH2Server(handler)
+	h2.sniffTimeout = 50 * time.Millisecond
+	conn := dialH2(t, serveH2(t, h2, handler))
+	// a client that never says anything is disconnected
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() || err == nil {
+		t.Fatalf("got %v, want the idle connection closed", err)
+	}
+}
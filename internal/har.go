@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats flytrap export can write
+const (
+	ExportHAR   = "har"
+	ExportJSONL = "jsonl" // a snapshot that flytrap import restores
+)
+
+// ExportOptions selects what flytrap export writes and where it reads the captures from
+type ExportOptions struct {
+	Format  string
+	URL     string     // query server of a running flytrap, the disk store in DataDir is read when empty
+	DataDir string     // disk store to read
+	Filter  url.Values // path, prefix, method, bin, since and until, as the export endpoints take them
+}
+
+// Export writes the captured requests in the requested format
+func Export(opts ExportOptions, w io.Writer) error {
+	if opts.Format != ExportHAR && opts.Format != ExportJSONL {
+		return fmt.Errorf("unknown export format: %s (use %s or %s)", opts.Format, ExportHAR, ExportJSONL)
+	}
+	if opts.URL != "" {
+		return exportFrom(opts, w)
+	}
+	store, err := readDiskStore(opts.DataDir)
+	if err != nil {
+		return fmt.Errorf("reading the disk store (use --url to export from a running flytrap): %v", err)
+	}
+	m, err := newRequestMatcher(opts.Filter)
+	if err != nil {
+		return err
+	}
+	if opts.Format == ExportJSONL {
+		// rules only live in a running flytrap, the snapshot has the bins and requests
+		env := newCaptureEnv(store, "")
+		if env.bins, err = openBinRegistry(filepath.Join(opts.DataDir, binsFile)); err != nil {
+			return err
+		}
+		return writeSnapshot(w, m, len(opts.Filter) > 0, env)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newHAR(m, store))
+}
+
+// exportFrom downloads the export from the query server of a running flytrap
+func exportFrom(opts ExportOptions, w io.Writer) error {
+	u := strings.TrimSuffix(opts.URL, "/") + "/api/v1/export." + opts.Format
+	if len(opts.Filter) > 0 {
+		u += "?" + opts.Filter.Encode()
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var ae apiError
+		json.NewDecoder(resp.Body).Decode(&ae)
+		return fmt.Errorf("export from %s failed: %s %s", opts.URL, resp.Status, ae.Error)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// The HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/
+// Fields flytrap adds that are not in the spec start with an underscore.
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time      `json:"startedDateTime"`
+	Time            float64        `json:"time"` // milliseconds
+	Request         harRequest     `json:"request"`
+	Response        harResponse    `json:"response"`
+	Cache           struct{}       `json:"cache"`
+	Timings         harTimings     `json:"timings"`
+	Connection      string         `json:"connection,omitempty"` // the client address, which tells connections apart
+	Comment         string         `json:"comment,omitempty"`
+	ID              string         `json:"_id"`
+	Path            string         `json:"_path"`                   // the path the request was captured under
+	ResourceType    string         `json:"_resourceType,omitempty"` // chrome devtools shows the frames of websocket entries
+	WebSocket       []harWebSocket `json:"_webSocketMessages,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Trailers    []harNameValue `json:"_trailers,omitempty"`
+	GRPC        *GRPCCall      `json:"_grpc,omitempty"`
+	TLS         *TLSInfo       `json:"_tls,omitempty"`
+	Fault       *InjectedFault `json:"_fault,omitempty"`
+	Upstream    *harUpstream   `json:"_upstream,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Trailers    []harNameValue `json:"_trailers,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"_encoding,omitempty"` // base64 when the body is not utf8
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harWebSocket is a websocket frame in the layout chrome devtools uses
+type harWebSocket struct {
+	Type   string  `json:"type"` // send or receive, from the client's side
+	Time   float64 `json:"time"` // unix seconds
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+type harUpstream struct {
+	URL      string  `json:"url"`
+	Status   int     `json:"status,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"` // milliseconds
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// newHAR converts the stored requests that match into a HAR document, oldest first
+func newHAR(m requestMatcher, store storage) harDocument {
+	type stored struct {
+		path string
+		cr   *CapturedRequest
+	}
+	var found []stored
+	m.each(store, func(path string, cr *CapturedRequest) {
+		found = append(found, stored{path, cr})
+	})
+	sort.SliceStable(found, func(i, j int) bool { return found[i].cr.ReceivedAt.Before(found[j].cr.ReceivedAt) })
+
+	doc := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "flytrap", Version: "1"},
+		Entries: make([]harEntry, 0, len(found)),
+	}}
+	for _, s := range found {
+		doc.Log.Entries = append(doc.Log.Entries, newHAREntry(s.path, s.cr))
+	}
+	return doc
+}
+
+func newHAREntry(path string, cr *CapturedRequest) harEntry {
+	e := harEntry{
+		StartedDateTime: cr.ReceivedAt,
+		ID:              cr.ID,
+		Path:            path,
+		Connection:      cr.RemoteAddr,
+		Timings:         harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+	}
+	e.Request = harRequest{
+		Method:      cr.Method,
+		URL:         harURL(cr),
+		HTTPVersion: cr.Proto,
+		Cookies:     harCookies((&http.Request{Header: cr.Header}).Cookies()),
+		Headers:     harHeaders(cr.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    cr.BodySize,
+		Trailers:    harHeaders(cr.Trailer),
+		GRPC:        cr.GRPC,
+		TLS:         cr.TLS,
+		Fault:       cr.Fault,
+	}
+	for name, values := range cr.URL().Query() {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(e.Request.QueryString, func(i, j int) bool { return e.Request.QueryString[i].Name < e.Request.QueryString[j].Name })
+	if cr.BodySize > 0 {
+		pd := &harPostData{MimeType: cr.Header.Get("Content-Type"), Params: []harNameValue{}}
+		pd.Text, pd.Encoding = harText(cr.Body)
+		if mt, _, _ := mime.ParseMediaType(pd.MimeType); mt == "application/x-www-form-urlencoded" && pd.Encoding == "" {
+			if form, err := url.ParseQuery(pd.Text); err == nil {
+				for name, values := range form {
+					for _, v := range values {
+						pd.Params = append(pd.Params, harNameValue{Name: name, Value: v})
+					}
+				}
+			}
+		}
+		e.Request.PostData = pd
+	}
+	if up := cr.Upstream; up != nil {
+		e.Request.Upstream = &harUpstream{URL: up.URL, Error: up.Error, Duration: millis(up.Duration)}
+		if up.Response != nil {
+			e.Request.Upstream.Status = up.Response.Status
+		}
+	}
+	if ws := cr.WebSocket; ws != nil {
+		e.ResourceType = "websocket"
+		for _, f := range ws.Frames {
+			hw := harWebSocket{Type: "receive", Time: float64(f.At.UnixMicro()) / 1e6, Opcode: wsOpcode(f.Type), Data: string(f.Payload)}
+			if f.Direction == wsDirectionIn {
+				hw.Type = "send"
+			}
+			if f.Type == "close" {
+				hw.Data = fmt.Sprintf("%d %s", f.CloseCode, f.CloseReason)
+			} else if !utf8.Valid(f.Payload) {
+				hw.Data, _ = harText(f.Payload)
+			}
+			e.WebSocket = append(e.WebSocket, hw)
+		}
+	}
+
+	resp := cr.Response
+	if resp == nil {
+		// HAR has no way to leave the response out, a status of 0 is what browsers record for requests without one
+		e.Response = harResponse{Cookies: []harCookie{}, Headers: []harNameValue{}, HTTPVersion: cr.Proto, HeadersSize: -1, BodySize: -1}
+		e.Comment = "no response recorded"
+		if cr.Fault != nil && cr.Fault.Connection != "" {
+			e.Comment = "connection " + cr.Fault.Connection + " injected by a fault"
+		}
+		return e
+	}
+	e.Response = harResponse{
+		Status:      resp.Status,
+		StatusText:  http.StatusText(resp.Status),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies((&http.Response{Header: resp.Header}).Cookies()),
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.BodySize,
+		Trailers:    harHeaders(resp.Trailer),
+		Content:     harContent{Size: resp.BodySize, MimeType: resp.Header.Get("Content-Type")},
+	}
+	e.Response.Content.Text, e.Response.Content.Encoding = harText(resp.Body)
+	if resp.BodyTruncated {
+		e.Response.Content.Comment = "body truncated"
+	}
+	if resp.Disconnected {
+		e.Comment = "client disconnected before the response ended"
+		if resp.Delivered > 0 {
+			e.Comment += fmt.Sprintf(", after %d events or chunks", resp.Delivered)
+		}
+	}
+	e.Time = millis(resp.Latency)
+	e.Timings.Wait = e.Time
+	return e
+}
+
+// harURL rebuilds the absolute url the request was sent to, HTTP/1.0 requests may not have said which host
+func harURL(cr *CapturedRequest) string {
+	u := cr.URL()
+	u.Scheme, u.Host = "http", cr.Host
+	if cr.TLS != nil {
+		u.Scheme = "https"
+	}
+	if u.Host == "" {
+		u.Host = "localhost"
+	}
+	return u.String()
+}
+
+// harHeaders lists the headers sorted by name
+func harHeaders(h http.Header) []harNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nvs := []harNameValue{}
+	for _, name := range names {
+		for _, v := range h[name] {
+			nvs = append(nvs, harNameValue{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	hcs := []harCookie{}
+	for _, c := range cookies {
+		hc := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			hc.Expires = &c.Expires
+		}
+		hcs = append(hcs, hc)
+	}
+	return hcs
+}
+
+// harText returns the body as text, or base64 with the encoding set if it is not utf8
+func harText(body []byte) (string, string) {
+	text, encoding := encodeBody(body)
+	if encoding == bodyEncodingUTF8 {
+		return text, ""
+	}
+	return text, encoding
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func wsOpcode(frameType string) int {
+	for _, op := range []byte{wsContinuation, wsText, wsBinary, wsClose, wsPing, wsPong} {
+		if wsFrameType(op) == frameType {
+			return int(op)
+		}
+	}
+	return 0
+}
+
+// registerExportAPI adds the endpoints that export captures, filtered like wait plus until and bin
+func registerExportAPI(mux *http.ServeMux, store storage) {
+	mux.HandleFunc("GET /api/v1/export.har", func(w http.ResponseWriter, r *http.Request) {
+		m, err := newRequestMatcher(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="flytrap.har"`)
+		writeJSON(w, http.StatusOK, newHAR(m, store))
+	})
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Captured gRPC messages are decoded with the descriptors loaded from FileDescriptorSets (protoc --descriptor_set_out).
+// Messages without descriptors are read with a minimal wire format reader and keyed by field number.
+
+// protobuf wire types
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireLen    = 2
+	wireSGroup = 3
+	wireEGroup = 4
+	wireI32    = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// maxProtoDepth is how deep nested messages are decoded, the default recursion limit of the C++ protobuf parser.
+// Captured messages come from anyone who can reach the capture port, deeper ones would exhaust the stack.
+const maxProtoDepth = 100
+
+var errProtoTooDeep = fmt.Errorf("protobuf: messages nested more than %d deep", maxProtoDepth)
+
+type protoField struct {
+	number int
+	wire   int
+	varint uint64 // the value of varint, i64 and i32 fields
+	bytes  []byte // the value of len fields
+}
+
+// readProtoFields splits a message into its fields, in the order they appear
+func readProtoFields(b []byte) ([]protoField, error) {
+	fields := []protoField{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{number: int(tag >> 3), wire: int(tag & 7)}
+		if f.number <= 0 {
+			return nil, fmt.Errorf("protobuf: invalid field number %d", f.number)
+		}
+		switch f.wire {
+		case wireVarint:
+			if f.varint, n = binary.Uvarint(b); n <= 0 {
+				return nil, errProtoTruncated
+			}
+			b = b[n:]
+		case wireI64:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			f.varint, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireI32:
+			if len(b) < 4 {
+				return nil, errProtoTruncated
+			}
+			f.varint, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireLen:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, errProtoTruncated
+			}
+			f.bytes, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			// groups are long deprecated, nothing flytrap decodes uses them
+			return nil, fmt.Errorf("protobuf: unsupported wire type %d", f.wire)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+type protoMethodDesc struct {
+	input, output                    string
+	clientStreaming, serverStreaming bool
+}
+
+// protoRegistry holds the files loaded from descriptor sets and the methods of their services
+type protoRegistry struct {
+	files   map[string]*descriptorpb.FileDescriptorProto // by file name, the first set that has a file wins
+	types   *dynamicpb.Types
+	methods map[string]*protoMethodDesc // keyed by service/method, eg: helloworld.Greeter/SayHello
+}
+
+func newProtoRegistry() *protoRegistry {
+	return &protoRegistry{
+		files:   make(map[string]*descriptorpb.FileDescriptorProto),
+		types:   dynamicpb.NewTypes(new(protoregistry.Files)),
+		methods: make(map[string]*protoMethodDesc),
+	}
+}
+
+// loadFile adds the contents of a FileDescriptorSet file
+func (reg *protoRegistry) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := reg.loadDescriptorSet(b); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// loadDescriptorSet adds the files of a set to the ones loaded before, types they import that are in
+// none of the sets are left unresolved
+func (reg *protoRegistry) loadDescriptorSet(b []byte) error {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return err
+	}
+	for _, fd := range set.File {
+		if _, ok := reg.files[fd.GetName()]; !ok {
+			reg.files[fd.GetName()] = fd
+		}
+	}
+	all := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range reg.files {
+		all.File = append(all.File, fd)
+	}
+	files, err := protodesc.FileOptions{AllowUnresolvable: true}.NewFiles(all)
+	if err != nil {
+		return err
+	}
+	reg.types = dynamicpb.NewTypes(files)
+	files.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+		for i := 0; i < f.Services().Len(); i++ {
+			sd := f.Services().Get(i)
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				reg.methods[string(sd.FullName())+"/"+string(md.Name())] = &protoMethodDesc{
+					input:           string(md.Input().FullName()),
+					output:          string(md.Output().FullName()),
+					clientStreaming: md.IsStreamingClient(),
+					serverStreaming: md.IsStreamingServer(),
+				}
+			}
+		}
+		return true
+	})
+	return nil
+}
+
+// decode converts a message of the named type to json with the proto3 json mapping.
+// Fields that are not in the descriptors are left out.
+func (reg *protoRegistry) decode(typeName string, b []byte) (json.RawMessage, error) {
+	mt, err := reg.types.FindMessageByName(protoreflect.FullName(typeName))
+	if err != nil {
+		return nil, fmt.Errorf("unknown message type: %s", typeName)
+	}
+	msg := mt.New().Interface()
+	opts := proto.UnmarshalOptions{RecursionLimit: maxProtoDepth, Resolver: reg.types}
+	if err := opts.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	out, err := protojson.MarshalOptions{Resolver: reg.types}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	// protojson varies its spacing on purpose, the stored json is kept compact
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, out); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+// decodeUnknown shows a field without a descriptor as best it can, len fields are shown as text if they are
+// printable, as a message if they parse as one, or as base64. depth is the depth of the message it may hold.
+func decodeUnknown(f protoField, depth int) any {
+	switch f.wire {
+	case wireLen:
+		if utf8.Valid(f.bytes) && printable(f.bytes) {
+			return string(f.bytes)
+		}
+		if m, err := decodeSchemaless(f.bytes, depth); err == nil {
+			return m
+		}
+		return base64.StdEncoding.EncodeToString(f.bytes)
+	}
+	// 64 bit values are strings in json so they survive javascript, as protojson has them
+	return strconv.FormatUint(f.varint, 10)
+}
+
+func printable(b []byte) bool {
+	for _, r := range string(b) {
+		if r < ' ' && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeSchemaless shows a message whose type is not known, keyed by field number
+func decodeSchemaless(b []byte, depth int) (map[string]any, error) {
+	if depth > maxProtoDepth {
+		return nil, errProtoTooDeep
+	}
+	fields, err := readProtoFields(b)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	for _, f := range fields {
+		key := strconv.Itoa(f.number)
+		v := decodeUnknown(f, depth+1)
+		switch prev := out[key].(type) {
+		case nil:
+			out[key] = v
+		case []any:
+			out[key] = append(prev, v)
+		default:
+			out[key] = []any{prev, v}
+		}
+	}
+	return out, nil
+}
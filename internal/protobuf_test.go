@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// nestedMessage wraps an empty message depth times in field 2
+func nestedMessage(depth int) []byte {
+	sizes := make([]int, depth+1) // sizes[i] is the size of the message wrapped i times
+	for i := 1; i <= depth; i++ {
+		sizes[i] = 1 + len(binary.AppendUvarint(nil, uint64(sizes[i-1]))) + sizes[i-1]
+	}
+	b := make([]byte, 0, sizes[depth])
+	for i := depth; i > 0; i-- {
+		b = binary.AppendUvarint(append(b, 0x12), uint64(sizes[i-1]))
+	}
+	return b
+}
+
+// schemalessDepth counts the messages decoded one inside the other
+func schemalessDepth(m map[string]any) (int, any) {
+	depth := 1
+	v := m["2"]
+	for next, ok := v.(map[string]any); ok; next, ok = v.(map[string]any) {
+		depth++
+		v = next["2"]
+	}
+	return depth, v
+}
+
+func TestDecodeSchemalessDepthLimit(t *testing.T) {
+	m, err := decodeSchemaless(nestedMessage(maxProtoDepth), 1)
+	if err != nil {
+		t.Fatalf("decoding a message within the depth limit: %v", err)
+	}
+	if depth, _ := schemalessDepth(m); depth != maxProtoDepth {
+		t.Errorf("decoded %d levels, want %d", depth, maxProtoDepth)
+	}
+
+	// deeper messages are shown as base64 past the limit instead of exhausting the stack
+	m, err = decodeSchemaless(nestedMessage(100_000), 1)
+	if err != nil {
+		t.Fatalf("decoding a deep message: %v", err)
+	}
+	depth, innermost := schemalessDepth(m)
+	if _, ok := innermost.(string); depth != maxProtoDepth || !ok {
+		t.Errorf("decoded %d levels down to a %T, want %d levels down to base64", depth, innermost, maxProtoDepth)
+	}
+	if _, err := decodeSchemaless(nestedMessage(1), maxProtoDepth+1); err != errProtoTooDeep {
+		t.Errorf("got %v, want %v", err, errProtoTooDeep)
+	}
+}
+
+// testRegistry loads test.proto: a Node with a child Node, a map, an int64 and an enum, and a Tree service
+func testRegistry(t *testing.T) *protoRegistry {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string,
+		label descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), JsonName: proto.String(name),
+			Number: proto.Int32(number), Type: typ.Enum(), Label: label.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional, repeated := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Node"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("child", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Node", optional),
+				field("counts", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Node.CountsEntry", repeated),
+				field("big", 4, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", optional),
+				field("color", 5, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Color", optional),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("CountsEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", optional),
+					field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", optional),
+				},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Color"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("RED"), Number: proto.Int32(0)},
+				{Name: proto.String("BLUE"), Number: proto.Int32(1)},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Tree"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name: proto.String("Grow"), InputType: proto.String(".test.Node"), OutputType: proto.String(".test.Node"),
+				ServerStreaming: proto.Bool(true),
+			}},
+		}},
+	}
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newProtoRegistry()
+	if err := reg.loadDescriptorSet(b); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestLoadDescriptorSetMethods(t *testing.T) {
+	md, ok := testRegistry(t).methods["test.Tree/Grow"]
+	if !ok || md.input != "test.Node" || md.output != "test.Node" || md.clientStreaming || !md.serverStreaming {
+		t.Errorf("got method %+v, want test.Node in and a stream of test.Node out", md)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	reg := testRegistry(t)
+	var b []byte
+	// map entries that leave out their default key or value, the way proto3 encoders do
+	b = append(b, 0x1a, 0x00)
+	b = append(b, 0x1a, 0x03, 0x0a, 0x01, 'a')
+	b = append(b, 0x1a, 0x02, 0x10, 0x07)
+	// 2^53 + 1, which a json number can't hold
+	b = binary.AppendUvarint(append(b, 0x20), 1<<53+1)
+	b = append(b, 0x28, 0x01)
+	// a field the descriptor doesn't have
+	b = append(b, 0x48, 0x01)
+
+	got, err := reg.decode("test.Node", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"counts":{"":"7","a":"0"},"big":"9007199254740993","color":"BLUE"}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := reg.decode("test.Missing", nil); err == nil {
+		t.Error("decoding an unknown type should fail")
+	}
+}
+
+func TestDecodeDepthLimit(t *testing.T) {
+	reg := testRegistry(t)
+	if _, err := reg.decode("test.Node", nestedMessage(maxProtoDepth-1)); err != nil {
+		t.Fatalf("decoding a message within the depth limit: %v", err)
+	}
+	for _, depth := range []int{maxProtoDepth + 1, 100_000} {
+		if _, err := reg.decode("test.Node", nestedMessage(depth)); err == nil {
+			t.Fatalf("decoding a message nested %d deep should fail", depth)
+		}
+	}
+}
+
+func TestDecodeSchemalessVarint(t *testing.T) {
+	m, err := decodeSchemaless(binary.AppendUvarint([]byte{0x08}, 1<<53+1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["1"] != "9007199254740993" {
+		t.Errorf("got %#v, want the varint as a string", m["1"])
+	}
+}
+
+func TestReadGRPCMessagesDecodeLimit(t *testing.T) {
+	msg := append([]byte{0x0a}, binary.AppendUvarint(nil, maxGRPCDecoded/2)...)
+	msg = append(msg, make([]byte, maxGRPCDecoded/2)...)
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	var body []byte
+	for i := 0; i < 3; i++ {
+		body = append(append(body, frame...), msg...)
+	}
+	msgs, err := readGRPCMessages(body, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if msgs[0].Error != "" || msgs[0].JSON == nil {
+		t.Errorf("the first message should be decoded, got error: %q", msgs[0].Error)
+	}
+	if msgs[1].Error == "" || msgs[2].Error == "" || msgs[2].JSON != nil {
+		t.Error("messages over the decode limit should only be listed")
+	}
+}
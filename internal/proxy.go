@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamExchange is what happened when a captured request was forwarded to an upstream
+type UpstreamExchange struct {
+	URL      string            `json:"url"`
+	Response *CapturedResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Duration time.Duration     `json:"duration"`
+}
+
+// proxyRule forwards the requests captured under a path prefix to an upstream
+type proxyRule struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream"`
+	Strip    bool   `json:"strip,omitempty"` // remove the prefix from the path before forwarding
+
+	target *url.URL
+}
+
+// parseProxyRule reads a rule from either an upstream url, which forwards every path,
+// or prefix=upstream, eg: /api/=http://localhost:8080
+func parseProxyRule(s string) (*proxyRule, error) {
+	pr := &proxyRule{Prefix: "/", Upstream: s}
+	if strings.HasPrefix(s, "/") {
+		prefix, upstream, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid proxy: %s (use upstream or /prefix=upstream)", s)
+		}
+		pr.Prefix, pr.Upstream = prefix, upstream
+	}
+	return pr, pr.compile()
+}
+
+func (pr *proxyRule) compile() error {
+	if !strings.HasPrefix(pr.Prefix, "/") {
+		return fmt.Errorf("proxy prefix must start with /: %q", pr.Prefix)
+	}
+	target, err := url.Parse(pr.Upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream: %v", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return fmt.Errorf("invalid upstream: %s (use an absolute http or https url)", pr.Upstream)
+	}
+	pr.target = target
+	return nil
+}
+
+// forward proxies the request to the upstream and returns what happened.
+// The upstream response, or a 502 if the upstream could not be reached, is written to w as it arrives.
+// aborted is set when the response was cut short, by the client leaving or the upstream failing mid body,
+// the caller then has to abort its response with http.ErrAbortHandler once it has recorded it.
+func (pr *proxyRule) forward(w http.ResponseWriter, r *http.Request) (ex *UpstreamExchange, aborted bool) {
+	ex = &UpstreamExchange{}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(preq *httputil.ProxyRequest) {
+			if pr.Strip {
+				preq.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(preq.Out.URL.Path, pr.Prefix), "/")
+				preq.Out.URL.RawPath = ""
+			}
+			preq.SetURL(pr.target)
+			preq.SetXForwarded()
+			ex.URL = preq.Out.URL.String()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				// the body is the upgraded connection, which the proxy copies both ways until it closes
+				ex.Response = &CapturedResponse{Status: resp.StatusCode, Proto: resp.Proto, Header: resp.Header.Clone()}
+				return nil
+			}
+			// the body streams through to the client, the proxy closes it before ServeHTTP returns
+			ex.Response = recordResponse(resp)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Error forwarding to upstream: %s error: %v", ex.URL, err)
+			ex.Error = err.Error()
+			http.Error(w, "flytrap: upstream error: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+	start := time.Now()
+	defer func() {
+		ex.Duration = time.Since(start)
+		// the proxy aborts with a panic when it can't copy the whole body
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				panic(err)
+			}
+			aborted = true
+			if r.Context().Err() == nil {
+				ex.Error = "the upstream response was cut short"
+			}
+		}
+	}()
+	proxy.ServeHTTP(w, r)
+	return ex, false
+}
+
+// proxyRules holds the configured upstreams by path prefix
+type proxyRules struct {
+	mu    sync.RWMutex
+	rules map[string]*proxyRule
+}
+
+func newProxyRules() *proxyRules {
+	return &proxyRules{rules: make(map[string]*proxyRule)}
+}
+
+// set compiles and installs a rule, replacing any existing one for the same prefix
+func (prs *proxyRules) set(pr *proxyRule) error {
+	if err := pr.compile(); err != nil {
+		return err
+	}
+	prs.mu.Lock()
+	defer prs.mu.Unlock()
+	prs.rules[pr.Prefix] = pr
+	return nil
+}
+
+func (prs *proxyRules) remove(prefix string) bool {
+	prs.mu.Lock()
+	defer prs.mu.Unlock()
+	_, ok := prs.rules[prefix]
+	delete(prs.rules, prefix)
+	return ok
+}
+
+// removePrefix removes all the rules for prefixes under prefix
+func (prs *proxyRules) removePrefix(prefix string) {
+	prs.mu.Lock()
+	defer prs.mu.Unlock()
+	for p := range prs.rules {
+		if strings.HasPrefix(p, prefix) {
+			delete(prs.rules, p)
+		}
+	}
+}
+
+// lookup finds the rule with the longest prefix that matches the path
+func (prs *proxyRules) lookup(path string) *proxyRule {
+	prs.mu.RLock()
+	defer prs.mu.RUnlock()
+	var found *proxyRule
+	for prefix, pr := range prs.rules {
+		if strings.HasPrefix(path, prefix) && (found == nil || len(prefix) > len(found.Prefix)) {
+			found = pr
+		}
+	}
+	return found
+}
+
+func (prs *proxyRules) list() []*proxyRule {
+	prs.mu.RLock()
+	defer prs.mu.RUnlock()
+	all := make([]*proxyRule, 0, len(prs.rules))
+	for _, pr := range prs.rules {
+		all = append(all, pr)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Prefix < all[j].Prefix })
+	return all
+}
+
+// registerProxyAPI adds the endpoints to list, set and remove upstreams
+func registerProxyAPI(mux *http.ServeMux, prs *proxyRules) {
+	mux.HandleFunc("GET /api/v1/proxies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, prs.list())
+	})
+
+	mux.HandleFunc("PUT /api/v1/proxies", func(w http.ResponseWriter, r *http.Request) {
+		pr := &proxyRule{}
+		if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid proxy: "+err.Error())
+			return
+		}
+		if pr.Prefix == "" {
+			pr.Prefix = "/"
+		}
+		if err := prs.set(pr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, pr)
+	})
+
+	mux.HandleFunc("DELETE /api/v1/proxies", func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if !prs.remove(prefix) {
+			writeError(w, http.StatusNotFound, "no proxy configured for prefix: "+prefix)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
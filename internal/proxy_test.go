@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forwardingServer forwards every request with the rule, through a recorder like the capture handler,
+// and hands over what happened once each request is done
+func forwardingServer(t *testing.T, pr *proxyRule) (*httptest.Server, chan *UpstreamExchange) {
+	exchanges := make(chan *UpstreamExchange, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ex, _ := pr.forward(newResponseRecorder(w, time.Now()), r)
+		exchanges <- ex
+	}))
+	t.Cleanup(srv.Close)
+	return srv, exchanges
+}
+
+func TestProxyForward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("got: "), body...))
+	}))
+	defer upstream.Close()
+
+	pr, err := parseProxyRule("/api/=" + upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.Strip = true
+	srv, exchanges := forwardingServer(t, pr)
+
+	resp, err := http.Post(srv.URL+"/api/orders?x=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ex := <-exchanges
+
+	if resp.StatusCode != http.StatusCreated || string(body) != "got: hello" {
+		t.Errorf("the caller got %d %q, want the upstream response", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("X-Upstream-Path"); got != "/orders" {
+		t.Errorf("upstream saw path %q, want the prefix stripped", got)
+	}
+	if resp.Header.Get("X-Forwarded-For") == "" {
+		t.Error("the upstream should see X-Forwarded-For")
+	}
+	if ex.URL != upstream.URL+"/orders?x=1" || ex.Error != "" {
+		t.Errorf("got exchange with url %q and error %q", ex.URL, ex.Error)
+	}
+	if ex.Response == nil || ex.Response.Status != http.StatusCreated || string(ex.Response.Body) != "got: hello" {
+		t.Errorf("recorded upstream response %+v, want the one the caller got", ex.Response)
+	}
+}
+
+func TestProxyUnreachableUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	pr, err := parseProxyRule("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, exchanges := forwardingServer(t, pr)
+	resp, err := http.Get(srv.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ex := <-exchanges
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	if ex.Error == "" || ex.Response != nil {
+		t.Errorf("got exchange %+v, want an error and no response", ex)
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	// the upstream switches protocols and echoes whatever it reads
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nX-Upstream: yes\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer upstream.Close()
+
+	pr, err := parseProxyRule(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, exchanges := forwardingServer(t, pr)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: flytrap\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("reading the upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// the upgraded connection carries data both ways
+	io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("got %q %v, want the upstream to echo ping", echo, err)
+	}
+	conn.Close()
+
+	select {
+	case ex := <-exchanges:
+		if ex.Error != "" || ex.Response == nil || ex.Response.Status != http.StatusSwitchingProtocols {
+			t.Fatalf("got exchange %+v, want a recorded 101", ex)
+		}
+		if ex.Response.Header.Get("X-Upstream") != "yes" || len(ex.Response.Body) != 0 {
+			t.Errorf("recorded %+v, want the upstream headers and no body", ex.Response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarding did not finish after the connection closed")
+	}
+}
+
+func TestProxyStreams(t *testing.T) {
+	// the upstream sends an event, then holds the response open until the test lets it finish
+	finish := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Trailer", "X-Events")
+		io.WriteString(w, "data: first\n\n")
+		http.NewResponseController(w).Flush()
+		<-finish
+		io.WriteString(w, "data: second\n\n")
+		w.Header().Set("X-Events", "2")
+	}))
+	defer upstream.Close()
+
+	pr, err := parseProxyRule(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, exchanges := forwardingServer(t, pr)
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	first := make([]byte, len("data: first\n\n"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil || string(first) != "data: first\n\n" {
+			t.Fatalf("got %q %v, want the first event", first, err)
+		}
+	case <-time.After(5 * time.Second):
+		close(finish)
+		t.Fatal("the first event was held back until the upstream finished")
+	}
+	close(finish)
+	io.ReadAll(resp.Body)
+
+	ex := <-exchanges
+	const events = "data: first\n\ndata: second\n\n"
+	if ex.Response == nil || string(ex.Response.Body) != events || ex.Response.BodySize != int64(len(events)) {
+		t.Fatalf("recorded %+v, want both events", ex.Response)
+	}
+	if ex.Response.Trailer.Get("X-Events") != "2" {
+		t.Errorf("recorded trailers %v, want the upstream's", ex.Response.Trailer)
+	}
+}
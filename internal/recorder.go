@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxRecordedBody caps how much of a body is held in memory while it is being read or written,
+// long running streams would otherwise grow it forever. Retention limits apply on top of this when it is stored,
+// request bodies are only read up to --max-body-bytes when it is set.
+const maxRecordedBody = 16 << 20
+
+// responseRecorder passes a response through to the client while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	header  http.Header // snapshot of the headers when they were sent
+	body    bytes.Buffer
+	size    int64
+	started time.Time
+}
+
+func newResponseRecorder(w http.ResponseWriter, started time.Time) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, started: started}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 || status == http.StatusSwitchingProtocols {
+		rec.status = status
+		rec.header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += int64(n)
+	if room := maxRecordedBody - rec.body.Len(); room > 0 {
+		rec.body.Write(b[:min(n, room)])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flusher and hijacker of the underlying writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// response returns what was sent so far, a handler that wrote nothing sent an empty 200
+func (rec *responseRecorder) response(proto string) *CapturedResponse {
+	status, header := rec.status, rec.header
+	if status == 0 {
+		status, header = http.StatusOK, rec.Header().Clone()
+	}
+	resp := &CapturedResponse{
+		Status:        status,
+		Proto:         proto,
+		Header:        header,
+		Body:          bytes.Clone(rec.body.Bytes()),
+		BodySize:      rec.size,
+		BodyTruncated: int64(rec.body.Len()) < rec.size,
+		Latency:       time.Since(rec.started),
+	}
+	// trailers are the headers announced in Trailer, or set with the TrailerPrefix, once the body is written
+	trailer := http.Header{}
+	for _, name := range header.Values("Trailer") {
+		for _, t := range strings.Split(name, ",") {
+			t = http.CanonicalHeaderKey(strings.TrimSpace(t))
+			if values := rec.Header().Values(t); len(values) > 0 {
+				trailer[t] = values
+			}
+		}
+	}
+	for name, values := range rec.Header() {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))] = values
+		}
+	}
+	if len(trailer) > 0 {
+		resp.Trailer = trailer
+	}
+	return resp
+}
@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// mockResponse is what the capture server replies with for requests on a path.
+// A path ending in /* matches every path under it, an empty Method matches requests with any method.
+// When Template is set the body and header values are go templates evaluated against the request,
+// with the helpers in templateFuncs, eg: {"body": "{\"challenge\": \"{{ .Query.Get \"challenge\" }}\"}", "template": true}
+type mockResponse struct {
+	Path     string            `json:"path"`
+	Method   string            `json:"method,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Template bool              `json:"template,omitempty"`
+	Echo     bool              `json:"echo,omitempty"` // reply with the request as json instead of Body, see writeEcho
+
+	// WebSocket is how websockets opened on the path are answered, requests that are not websocket upgrades
+	// get the rest of the response
+	WebSocket *wsScript `json:"websocket,omitempty"`
+	// Stream sends the body as a sequence of server sent events or chunks instead
+	Stream *streamScript `json:"stream,omitempty"`
+	// GRPC is how grpc calls on the path are answered
+	GRPC *grpcReply `json:"grpc,omitempty"`
+	// Sequence replies to each request with the next of these steps instead, Then says what happens
+	// once they have all been used: sequenceLast or sequenceLoop
+	Sequence []sequenceStep `json:"sequence,omitempty"`
+	Then     string         `json:"then,omitempty"`
+
+	bodyTmpl    *template.Template
+	headerTmpls map[string]*template.Template
+	sequence    *sequenceState
+}
+
+// duration is a time.Duration that reads and writes json as a go duration string, eg: "250ms"
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings in go format, eg: 250ms")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// templateRequest is the data a response template is evaluated against
+type templateRequest struct {
+	ID         string
+	Method     string
+	Host       string
+	Path       string
+	Query      url.Values
+	Header     http.Header
+	Body       string
+	JSON       any // the body decoded as json, nil if it isn't json
+	RemoteAddr string
+	ReceivedAt time.Time
+}
+
+func newTemplateRequest(cr *CapturedRequest) templateRequest {
+	return templateRequest{
+		ID:         cr.ID,
+		Method:     cr.Method,
+		Host:       cr.Host,
+		Path:       cr.Path,
+		Query:      cr.URL().Query(),
+		Header:     cr.Header,
+		Body:       string(cr.Body),
+		JSON:       parseJSONBody(cr.Body),
+		RemoteAddr: cr.RemoteAddr,
+		ReceivedAt: cr.ReceivedAt,
+	}
+}
+
+// compile validates the response and parses its templates
+func (mr *mockResponse) compile() error {
+	if !strings.HasPrefix(mr.Path, "/") {
+		return fmt.Errorf("response path must start with /: %q", mr.Path)
+	}
+	mr.Method = strings.ToUpper(mr.Method)
+	if mr.Status == 0 {
+		mr.Status = http.StatusOK
+	}
+	if mr.Status < 100 || mr.Status > 999 {
+		return fmt.Errorf("invalid response status: %d", mr.Status)
+	}
+	if mr.Stream != nil {
+		if err := mr.Stream.compile(); err != nil {
+			return err
+		}
+	}
+	if mr.Echo && (mr.Template || mr.Stream != nil || len(mr.Sequence) > 0) {
+		return fmt.Errorf("echo can't be combined with template, stream or sequence")
+	}
+	if len(mr.Sequence) > 0 {
+		if err := mr.compileSequence(); err != nil {
+			return err
+		}
+	}
+	if !mr.Template {
+		return nil
+	}
+
+	var err error
+	if mr.bodyTmpl, err = template.New("body").Funcs(templateFuncs).Parse(mr.Body); err != nil {
+		return fmt.Errorf("invalid body template: %v", err)
+	}
+	mr.headerTmpls = make(map[string]*template.Template, len(mr.Headers))
+	for name, value := range mr.Headers {
+		if mr.headerTmpls[name], err = template.New(name).Funcs(templateFuncs).Parse(value); err != nil {
+			return fmt.Errorf("invalid template for header %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// write sends the response for a captured request
+func (mr *mockResponse) write(w http.ResponseWriter, cr *CapturedRequest) {
+	if !mr.Template {
+		for name, value := range mr.Headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(mr.Status)
+		w.Write([]byte(mr.Body))
+		return
+	}
+
+	data := newTemplateRequest(cr)
+	var buf bytes.Buffer
+	for name, tmpl := range mr.headerTmpls {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, data); err != nil {
+			mr.templateError(w, err)
+			return
+		}
+		w.Header().Set(name, buf.String())
+	}
+	buf.Reset()
+	if err := mr.bodyTmpl.Execute(&buf, data); err != nil {
+		mr.templateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(mr.Status)
+	w.Write(buf.Bytes())
+}
+
+func (mr *mockResponse) templateError(w http.ResponseWriter, err error) {
+	log.Printf("Error evaluating response template for path: %s error: %v", mr.Path, err)
+	http.Error(w, "flytrap response template error: "+err.Error(), http.StatusInternalServerError)
+}
+
+// wildcardSuffix marks a response path that matches every path under it, eg: /hooks/*
+const wildcardSuffix = "/*"
+
+type responseKey struct {
+	path   string
+	method string
+}
+
+// responseRules holds the configured mock responses, keyed by path and method
+type responseRules struct {
+	mu    sync.RWMutex
+	rules map[responseKey]*mockResponse
+}
+
+func newResponseRules() *responseRules {
+	return &responseRules{rules: make(map[responseKey]*mockResponse)}
+}
+
+// set compiles and installs a response, replacing any existing one for the same path and method
+func (rr *responseRules) set(mr *mockResponse) error {
+	if err := mr.compile(); err != nil {
+		return err
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.rules[responseKey{path: mr.Path, method: mr.Method}] = mr
+	return nil
+}
+
+func (rr *responseRules) remove(path, method string) bool {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	key := responseKey{path: path, method: strings.ToUpper(method)}
+	_, ok := rr.rules[key]
+	delete(rr.rules, key)
+	return ok
+}
+
+// get returns the response set for exactly this path and method
+func (rr *responseRules) get(path, method string) *mockResponse {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return rr.rules[responseKey{path: path, method: strings.ToUpper(method)}]
+}
+
+// lookup finds the response for a request. An exact path wins over a wildcard path ending in /*,
+// and the longest wildcard wins over shorter ones. For each path a rule for the exact method wins over one for any method.
+func (rr *responseRules) lookup(path, method string) *mockResponse {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	if mr := rr.lookupPath(path, method); mr != nil {
+		return mr
+	}
+	for prefix := path; prefix != ""; {
+		prefix = prefix[:strings.LastIndex(prefix, "/")]
+		if mr := rr.lookupPath(prefix+wildcardSuffix, method); mr != nil {
+			return mr
+		}
+	}
+	return nil
+}
+
+// lookupPath finds the rule for a path, callers must hold rr.mu
+func (rr *responseRules) lookupPath(path, method string) *mockResponse {
+	if mr, ok := rr.rules[responseKey{path: path, method: method}]; ok {
+		return mr
+	}
+	return rr.rules[responseKey{path: path}]
+}
+
+// removePrefix removes all the rules for paths under prefix
+func (rr *responseRules) removePrefix(prefix string) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for key := range rr.rules {
+		if strings.HasPrefix(key.path, prefix) {
+			delete(rr.rules, key)
+		}
+	}
+}
+
+func (rr *responseRules) list() []*mockResponse {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	all := make([]*mockResponse, 0, len(rr.rules))
+	for _, mr := range rr.rules {
+		all = append(all, mr)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Path != all[j].Path {
+			return all[i].Path < all[j].Path
+		}
+		return all[i].Method < all[j].Method
+	})
+	return all
+}
+
+// loadFile installs the responses from a json file holding a list of responses
+func (rr *responseRules) loadFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var mrs []*mockResponse
+	if err := json.Unmarshal(data, &mrs); err != nil {
+		return fmt.Errorf("invalid responses file %s: %v", name, err)
+	}
+	for _, mr := range mrs {
+		if err := rr.set(mr); err != nil {
+			return fmt.Errorf("invalid response in %s: %v", name, err)
+		}
+	}
+	log.Printf("Loaded %d responses from %s", len(mrs), name)
+	return nil
+}
+
+// registerResponseAPI adds the endpoints to list, set and remove mock responses
+func registerResponseAPI(mux *http.ServeMux, rr *responseRules) {
+	mux.HandleFunc("GET /api/v1/responses", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, rr.list())
+	})
+
+	mux.HandleFunc("PUT /api/v1/responses", func(w http.ResponseWriter, r *http.Request) {
+		mr := &mockResponse{}
+		if err := json.NewDecoder(r.Body).Decode(mr); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid response: "+err.Error())
+			return
+		}
+		if err := rr.set(mr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, mr)
+	})
+
+	mux.HandleFunc("DELETE /api/v1/responses", func(w http.ResponseWriter, r *http.Request) {
+		path, method := r.URL.Query().Get("path"), r.URL.Query().Get("method")
+		if !rr.remove(path, method) {
+			writeError(w, http.StatusNotFound, "no response configured for path: "+path+" method: "+method)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
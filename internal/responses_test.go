@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResponseLookupPriority(t *testing.T) {
+	rr := newResponseRules()
+	for _, mr := range []*mockResponse{
+		{Path: "/*", Body: "root"},
+		{Path: "/hooks/*", Body: "hooks"},
+		{Path: "/hooks/*", Method: "get", Body: "hooks get"},
+		{Path: "/hooks/github/*", Body: "github"},
+		{Path: "/hooks/github/push", Method: "POST", Body: "push post"},
+	} {
+		if err := rr.set(mr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		path, method, want string
+	}{
+		{"/hooks/github/push", "POST", "push post"},
+		// the exact path only has a POST rule, the longest wildcard answers the rest
+		{"/hooks/github/push", "GET", "github"},
+		{"/hooks/github", "POST", "hooks"},
+		{"/hooks/gitlab/push", "GET", "hooks get"},
+		{"/hooks/gitlab/push", "PUT", "hooks"},
+		{"/hooks", "GET", "root"},
+		{"/other", "GET", "root"},
+	} {
+		if mr := rr.lookup(tc.path, tc.method); mr == nil || mr.Body != tc.want {
+			t.Errorf("%s %s: got %+v, want %q", tc.method, tc.path, mr, tc.want)
+		}
+	}
+}
+
+func TestResponseCompile(t *testing.T) {
+	for _, mr := range []*mockResponse{
+		{Path: "hooks"},
+		{Path: "/hooks", Status: 42},
+		{Path: "/hooks", Echo: true, Template: true},
+		{Path: "/hooks", Template: true, Body: "{{ .Nope"},
+		{Path: "/hooks", Stream: &streamScript{Events: []sseEvent{{Data: "a"}}, Chunks: []streamChunk{{Data: "b"}}}},
+	} {
+		if err := mr.compile(); err == nil {
+			t.Errorf("%+v compiled, want an error", mr)
+		}
+	}
+}
+
+func TestMockResponseServed(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	err := env.responses.set(&mockResponse{Path: "/hooks", Status: http.StatusTeapot,
+		Headers: map[string]string{"X-Mock": "yes"}, Body: "short and stout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, completed := captureServer(t, env, "/hooks")
+	resp, err := http.Post(srv.URL+"/hooks", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot || resp.Header.Get("X-Mock") != "yes" || string(body) != "short and stout" {
+		t.Errorf("got %d %v %q, want the mock response", resp.StatusCode, resp.Header, body)
+	}
+	if got := waitCompleted(t, completed).Response; got == nil || got.Status != http.StatusTeapot || string(got.Body) != "short and stout" {
+		t.Errorf("recorded %+v, want the mock response", got)
+	}
+}
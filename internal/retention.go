@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"container/list"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+)
+
+// RetentionLimits bound how much a store keeps, a zero value means no limit
+type RetentionLimits struct {
+	MaxRequestsPerPath int   // older requests on a path are evicted first, like a ring buffer
+	MaxTotalBytes      int64 // the oldest requests across all paths are evicted once this is exceeded
+	MaxBodyBytes       int64 // bodies are truncated to this size before they are stored
+}
+
+func (l RetentionLimits) enabled() bool {
+	return l.MaxRequestsPerPath > 0 || l.MaxTotalBytes > 0 || l.MaxBodyBytes > 0
+}
+
+// retentionStats counts what a boundedStore holds and what it had to let go of
+type retentionStats struct {
+	Requests          int   `json:"requests"`
+	Bytes             int64 `json:"bytes"`
+	EvictedRequests   int64 `json:"evictedRequests"`
+	EvictedBytes      int64 `json:"evictedBytes"`
+	TruncatedRequests int64 `json:"truncatedRequests"`
+	TruncatedBytes    int64 `json:"truncatedBytes"`
+}
+
+type retainedRequest struct {
+	key  string
+	id   string
+	size int64
+	cut  int64 // how many body bytes were not kept
+}
+
+// boundedStore enforces RetentionLimits on top of another store.
+// It keeps its own index of every stored request, oldest first, to decide what to evict.
+// Only the index is under the global lock, the writes to the wrapped store are ordered by the lock of their key,
+// so captures on different paths don't wait on each other's writes.
+type boundedStore struct {
+	storage
+	limits RetentionLimits
+
+	keys [memStoreShards]sync.Mutex // orders the store writes and index updates of the keys hashed to each
+
+	mu    sync.Mutex
+	order *list.List                 // all requests, oldest first
+	byKey map[string][]*list.Element // the requests of each key, oldest first
+	stats retentionStats
+}
+
+// newBoundedStore wraps store, indexing and trimming whatever it already holds
+func newBoundedStore(store storage, limits RetentionLimits) *boundedStore {
+	bs := &boundedStore{
+		storage: store,
+		limits:  limits,
+		order:   list.New(),
+		byKey:   make(map[string][]*list.Element),
+	}
+
+	existing := []retainedRequest{}
+	received := map[string]int64{}
+	store.foreach(func(key string, values []*CapturedRequest) bool {
+		for _, v := range values {
+			existing = append(existing, retainedRequest{key: key, id: v.ID, size: v.size()})
+			received[v.ID] = v.ReceivedAt.UnixNano()
+		}
+		return true
+	})
+	sort.SliceStable(existing, func(i, j int) bool { return received[existing[i].id] < received[existing[j].id] })
+
+	var evicted []retainedRequest
+	bs.mu.Lock()
+	for _, rr := range existing {
+		evicted = append(evicted, bs.track(rr)...)
+	}
+	bs.mu.Unlock()
+	bs.drop(evicted)
+	return bs
+}
+
+// keyLock is the lock that orders the changes to key
+func (bs *boundedStore) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &bs.keys[h.Sum32()%memStoreShards]
+}
+
+func (bs *boundedStore) append(key string, value *CapturedRequest) {
+	value, cut := bs.truncate(value)
+	kl := bs.keyLock(key)
+	kl.Lock()
+	defer kl.Unlock()
+	bs.storage.append(key, value)
+	bs.mu.Lock()
+	evicted := bs.track(retainedRequest{key: key, id: value.ID, size: value.size(), cut: cut})
+	bs.mu.Unlock()
+	bs.drop(evicted)
+}
+
+func (bs *boundedStore) update(key string, value *CapturedRequest) bool {
+	value, cut := bs.truncate(value)
+	kl := bs.keyLock(key)
+	kl.Lock()
+	defer kl.Unlock()
+	if !bs.storage.update(key, value) {
+		return false
+	}
+	var evicted []retainedRequest
+	bs.mu.Lock()
+	for _, e := range bs.byKey[key] {
+		if rr := e.Value.(retainedRequest); rr.id == value.ID {
+			size := value.size()
+			bs.stats.Bytes += size - rr.size
+			rr.size = size
+			// the request is stored again in full on completion, only what was cut since is counted
+			if rr.cut == 0 && cut > 0 {
+				bs.stats.TruncatedRequests++
+			}
+			bs.stats.TruncatedBytes += cut - rr.cut
+			rr.cut = cut
+			e.Value = rr
+			break
+		}
+	}
+	if max := bs.limits.MaxTotalBytes; max > 0 {
+		for bs.stats.Bytes > max && bs.order.Len() > 1 && bs.order.Front().Value.(retainedRequest).id != value.ID {
+			evicted = append(evicted, bs.evict(bs.order.Front()))
+		}
+	}
+	bs.mu.Unlock()
+	bs.drop(evicted)
+	return true
+}
+
+// truncate cuts the bodies of a request down to the configured size and says how many bytes were not kept,
+// including the part of the request body that was never read because it was over the limit already
+func (bs *boundedStore) truncate(value *CapturedRequest) (*CapturedRequest, int64) {
+	t := value.truncated(bs.limits.MaxBodyBytes)
+	cut := value.bodyBytes() - t.bodyBytes()
+	if value.BodyTruncated && value.BodySize > int64(len(value.Body)) {
+		cut += value.BodySize - int64(len(value.Body))
+	}
+	return t, cut
+}
+
+// track indexes a request and evicts whatever no longer fits, returning what the caller has to drop.
+// Callers must hold bs.mu.
+func (bs *boundedStore) track(rr retainedRequest) []retainedRequest {
+	var evicted []retainedRequest
+	bs.byKey[rr.key] = append(bs.byKey[rr.key], bs.order.PushBack(rr))
+	bs.stats.Requests++
+	bs.stats.Bytes += rr.size
+	if rr.cut > 0 {
+		bs.stats.TruncatedRequests++
+		bs.stats.TruncatedBytes += rr.cut
+	}
+
+	if max := bs.limits.MaxRequestsPerPath; max > 0 {
+		for len(bs.byKey[rr.key]) > max {
+			evicted = append(evicted, bs.evict(bs.byKey[rr.key][0]))
+		}
+	}
+	if max := bs.limits.MaxTotalBytes; max > 0 {
+		// never evict the request that was just stored, even if it doesn't fit on its own
+		for bs.stats.Bytes > max && bs.order.Len() > 1 {
+			evicted = append(evicted, bs.evict(bs.order.Front()))
+		}
+	}
+	return evicted
+}
+
+// evict takes a single request out of the index and counts it as evicted, the caller drops it from the store.
+// Callers must hold bs.mu.
+func (bs *boundedStore) evict(e *list.Element) retainedRequest {
+	rr := bs.untrack(e)
+	bs.stats.EvictedRequests++
+	bs.stats.EvictedBytes += rr.size
+	return rr
+}
+
+// drop removes evicted requests from the store. Callers must not hold bs.mu, a request
+// that is gone from the index already can't be evicted twice.
+func (bs *boundedStore) drop(evicted []retainedRequest) {
+	for _, rr := range evicted {
+		bs.storage.remove(rr.key, rr.id)
+	}
+}
+
+// untrack drops a request from the index. Callers must hold bs.mu.
+func (bs *boundedStore) untrack(e *list.Element) retainedRequest {
+	rr := bs.order.Remove(e).(retainedRequest)
+	elems := bs.byKey[rr.key]
+	for i, ke := range elems {
+		if ke == e {
+			elems = append(elems[:i:i], elems[i+1:]...)
+			break
+		}
+	}
+	if len(elems) == 0 {
+		delete(bs.byKey, rr.key)
+	} else {
+		bs.byKey[rr.key] = elems
+	}
+	bs.stats.Requests--
+	bs.stats.Bytes -= rr.size
+	return rr
+}
+
+func (bs *boundedStore) delete(key string) bool {
+	kl := bs.keyLock(key)
+	kl.Lock()
+	defer kl.Unlock()
+	bs.mu.Lock()
+	for _, e := range bs.byKey[key] {
+		bs.untrack(e)
+	}
+	bs.mu.Unlock()
+	return bs.storage.delete(key)
+}
+
+func (bs *boundedStore) remove(key string, ids ...string) int {
+	kl := bs.keyLock(key)
+	kl.Lock()
+	defer kl.Unlock()
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	bs.mu.Lock()
+	for _, e := range append([]*list.Element(nil), bs.byKey[key]...) {
+		if drop[e.Value.(retainedRequest).id] {
+			bs.untrack(e)
+		}
+	}
+	bs.mu.Unlock()
+	return bs.storage.remove(key, ids...)
+}
+
+func (bs *boundedStore) retentionStats() retentionStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.stats
+}
+
+// withRetention applies the limits to store, if there are any
+func withRetention(store storage, limits RetentionLimits) storage {
+	if !limits.enabled() {
+		return store
+	}
+	log.Printf("Retention limits: max requests per path: %d max total bytes: %d max body bytes: %d",
+		limits.MaxRequestsPerPath, limits.MaxTotalBytes, limits.MaxBodyBytes)
+	return newBoundedStore(store, limits)
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingStore holds appends on one key until it is released, like a disk stuck on a write
+type blockingStore struct {
+	storage
+	key     string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s blockingStore) append(key string, value *CapturedRequest) {
+	if key == s.key {
+		close(s.entered)
+		<-s.release
+	}
+	s.storage.append(key, value)
+}
+
+func TestBoundedStoreWritesInParallel(t *testing.T) {
+	store := blockingStore{storage: newMemStore(), key: "/blocked", entered: make(chan struct{}), release: make(chan struct{})}
+	bs := newBoundedStore(store, RetentionLimits{MaxRequestsPerPath: 1})
+	other := "/other"
+	for i := 0; bs.keyLock(other) == bs.keyLock(store.key); i++ {
+		other = fmt.Sprintf("/other/%d", i)
+	}
+
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		bs.append(store.key, testRequest("stuck"))
+	}()
+	<-store.entered
+
+	// a write on another path, one that evicts and a look at the stats don't wait on the stuck write
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bs.append(other, testRequest("a"))
+		bs.append(other, testRequest("b"))
+		bs.retentionStats()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the writes on another path waited for the stuck one")
+	}
+
+	close(store.release)
+	<-blocked
+	if stats := bs.retentionStats(); stats.Requests != 2 || stats.EvictedRequests != 1 {
+		t.Errorf("got %+v, want 2 stored and 1 evicted", stats)
+	}
+}
+
+func TestBoundedStoreEvicts(t *testing.T) {
+	bs := newBoundedStore(newMemStore(), RetentionLimits{MaxRequestsPerPath: 2})
+	for i := 0; i < 5; i++ {
+		bs.append("/a", testRequest(fmt.Sprint(i)))
+	}
+	values := bs.load("/a")
+	if len(values) != 2 || values[0].ID != "3" || values[1].ID != "4" {
+		t.Fatalf("kept %v, want the last 2 requests", values)
+	}
+	if stats := bs.retentionStats(); stats.EvictedRequests != 3 || stats.Requests != 2 {
+		t.Errorf("got %+v, want 3 evicted and 2 stored", stats)
+	}
+}
+
+func TestBoundedStoreCountsUnreadBody(t *testing.T) {
+	bs := newBoundedStore(newMemStore(), RetentionLimits{MaxBodyBytes: 5})
+	r := httptest.NewRequest("POST", "/big", strings.NewReader("hello world"))
+	cr, err := newCapturedRequest(r, bs.limits.MaxBodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.append(r.URL.Path, cr)
+	done := *cr
+	drainBody(r, &done)
+	bs.update(r.URL.Path, &done)
+
+	if stats := bs.retentionStats(); stats.TruncatedRequests != 1 || stats.TruncatedBytes != 6 {
+		t.Errorf("got %+v, want 1 truncated request missing 6 bytes", stats)
+	}
+}
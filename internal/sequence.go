@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What a sequence does once every step has been used
+const (
+	sequenceLast = "last" // keep replying with the last step
+	sequenceLoop = "loop" // start over from the first step
+)
+
+// sequenceStep is one of the responses of a sequence, used for a single request
+type sequenceStep struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Delay   duration          `json:"delay,omitempty"`
+}
+
+// sequenceState tracks the next step of a response sequence
+type sequenceState struct {
+	mu       sync.Mutex
+	position int // index of the step the next request gets
+	served   int // requests answered since the sequence was set or reset
+}
+
+// sequencePosition is where a sequence is at, as reported by the api
+type sequencePosition struct {
+	Path     string `json:"path"`
+	Method   string `json:"method,omitempty"`
+	Position int    `json:"position"` // the step the next request gets, starting at 0
+	Steps    int    `json:"steps"`
+	Served   int    `json:"served"`
+	Then     string `json:"then"`
+}
+
+func (mr *mockResponse) compileSequence() error {
+	if mr.Then == "" {
+		mr.Then = sequenceLast
+	}
+	if mr.Then != sequenceLast && mr.Then != sequenceLoop {
+		return fmt.Errorf("invalid sequence then: %q (use %s or %s)", mr.Then, sequenceLast, sequenceLoop)
+	}
+	if mr.Template || mr.Stream != nil {
+		return errors.New("a sequence can't be combined with template or stream")
+	}
+	for i := range mr.Sequence {
+		step := &mr.Sequence[i]
+		if step.Status == 0 {
+			step.Status = http.StatusOK
+		}
+		if step.Status < 100 || step.Status > 999 {
+			return fmt.Errorf("invalid status in sequence step %d: %d", i, step.Status)
+		}
+	}
+	mr.sequence = &sequenceState{}
+	return nil
+}
+
+// next takes the step for a request and moves the sequence along
+func (mr *mockResponse) next() sequenceStep {
+	s := mr.sequence
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	step := mr.Sequence[s.position]
+	s.served++
+	switch {
+	case s.position < len(mr.Sequence)-1:
+		s.position++
+	case mr.Then == sequenceLoop:
+		s.position = 0
+	}
+	return step
+}
+
+func (mr *mockResponse) sequencePosition() sequencePosition {
+	s := mr.sequence
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sequencePosition{
+		Path:     mr.Path,
+		Method:   mr.Method,
+		Position: s.position,
+		Steps:    len(mr.Sequence),
+		Served:   s.served,
+		Then:     mr.Then,
+	}
+}
+
+// resetSequence starts the sequence over from its first step
+func (mr *mockResponse) resetSequence() {
+	s := mr.sequence
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.position, s.served = 0, 0
+}
+
+// write sends the step after its delay, or nothing if the client leaves while it waits
+func (step sequenceStep) write(ctx context.Context, w http.ResponseWriter) {
+	if step.Delay > 0 {
+		select {
+		case <-time.After(time.Duration(step.Delay)):
+		case <-ctx.Done():
+			return
+		}
+	}
+	for name, value := range step.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(step.Status)
+	w.Write([]byte(step.Body))
+}
+
+// registerSequenceAPI adds the endpoints to see where a response sequence is at and to start it over
+func registerSequenceAPI(mux *http.ServeMux, rr *responseRules) {
+	lookup := func(w http.ResponseWriter, r *http.Request) (*mockResponse, bool) {
+		path, method := r.URL.Query().Get("path"), r.URL.Query().Get("method")
+		mr := rr.get(path, method)
+		if mr == nil || mr.sequence == nil {
+			writeError(w, http.StatusNotFound, "no sequence configured for path: "+path+" method: "+method)
+			return nil, false
+		}
+		return mr, true
+	}
+
+	mux.HandleFunc("GET /api/v1/responses/sequence", func(w http.ResponseWriter, r *http.Request) {
+		if mr, ok := lookup(w, r); ok {
+			writeJSON(w, http.StatusOK, mr.sequencePosition())
+		}
+	})
+
+	mux.HandleFunc("POST /api/v1/responses/sequence/reset", func(w http.ResponseWriter, r *http.Request) {
+		if mr, ok := lookup(w, r); ok {
+			mr.resetSequence()
+			writeJSON(w, http.StatusOK, mr.sequencePosition())
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSequenceThen(t *testing.T) {
+	for _, tc := range []struct {
+		then string
+		want []int
+	}{
+		{"", []int{500, 503, 200, 200, 200}},
+		{sequenceLoop, []int{500, 503, 200, 500, 503}},
+	} {
+		mr := &mockResponse{Path: "/retry", Then: tc.then, Sequence: []sequenceStep{{Status: 500}, {Status: 503}, {}}}
+		if err := mr.compile(); err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for range tc.want {
+			got = append(got, mr.next().Status)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("then %q: got %v, want %v", tc.then, got, tc.want)
+		}
+	}
+}
+
+func TestSequenceServedAndReset(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	err := env.responses.set(&mockResponse{Path: "/retry", Then: sequenceLoop,
+		Sequence: []sequenceStep{{Status: http.StatusServiceUnavailable}, {Body: "ok"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture, completed := captureServer(t, env, "/retry")
+	get := func() int {
+		resp, err := http.Get(capture.URL + "/retry")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		waitCompleted(t, completed)
+		return resp.StatusCode
+	}
+	if first, second := get(), get(); first != http.StatusServiceUnavailable || second != http.StatusOK {
+		t.Errorf("got %d then %d, want 503 then 200", first, second)
+	}
+	get()
+
+	api := apiServer(t, env)
+	q := "?" + url.Values{"path": {"/retry"}}.Encode()
+	var pos sequencePosition
+	if getJSON(t, api.URL+"/api/v1/responses/sequence"+q, &pos); pos.Position != 1 || pos.Served != 3 || pos.Steps != 2 {
+		t.Errorf("got %+v, want step 1 next after 3 requests", pos)
+	}
+	resp, err := http.Post(api.URL+"/api/v1/responses/sequence/reset"+q, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status := get(); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d after the reset, want the first step", status)
+	}
+	if status := getJSON(t, api.URL+"/api/v1/responses/sequence?path=/nope", nil); status != http.StatusNotFound {
+		t.Errorf("got status %d for a path without a sequence, want %d", status, http.StatusNotFound)
+	}
+}
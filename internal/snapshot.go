@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A snapshot is the store written as json lines, so a session can be attached to a bug report
+// and restored into another flytrap. The bins come first, then the responses, faults and proxies,
+// then every request, oldest first. Each line holds one of them, a request with the path it was captured under.
+type snapshotEntry struct {
+	Bin      *bin             `json:"bin,omitempty"`
+	Response *mockResponse    `json:"response,omitempty"`
+	Fault    *faultRule       `json:"fault,omitempty"`
+	Proxy    *proxyRule       `json:"proxy,omitempty"`
+	Path     string           `json:"path,omitempty"`
+	Request  *CapturedRequest `json:"request,omitempty"`
+}
+
+// ImportOptions selects where flytrap import restores a snapshot into
+type ImportOptions struct {
+	URL     string // query server of a running flytrap, the disk store in DataDir is written when empty
+	DataDir string // disk store to write, flytrap must not be running on it
+	Replace bool   // drop everything stored before restoring
+}
+
+// ImportResult counts what an import restored
+type ImportResult struct {
+	Bins         int `json:"bins"`
+	Rules        int `json:"rules"` // responses, faults and proxies
+	Requests     int `json:"requests"`
+	Skipped      int `json:"skipped"`                // requests that were already stored, by id
+	SkippedRules int `json:"skippedRules,omitempty"` // rules there was nowhere to keep, the disk store doesn't have them
+}
+
+// writeSnapshot writes the matching requests as json lines with the bins and rules of env. An unfiltered snapshot
+// has all of them, a filtered one the bins the written requests were captured in and the rules under those bins.
+func writeSnapshot(w io.Writer, m requestMatcher, filtered bool, env *captureEnv) error {
+	var found []snapshotEntry
+	m.each(env.store, func(path string, cr *CapturedRequest) {
+		found = append(found, snapshotEntry{Path: path, Request: cr})
+	})
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Request.ReceivedAt.Before(found[j].Request.ReceivedAt) })
+
+	var entries []snapshotEntry
+	var prefixes []string
+	for _, b := range env.bins.list() {
+		used := !filtered
+		for _, e := range found {
+			used = used || strings.HasPrefix(e.Path, b.prefix())
+		}
+		if used {
+			entries = append(entries, snapshotEntry{Bin: &b})
+			prefixes = append(prefixes, b.prefix())
+		}
+	}
+	written := func(path string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		}
+		return !filtered
+	}
+	for _, mr := range env.responses.list() {
+		if written(mr.Path) {
+			entries = append(entries, snapshotEntry{Response: mr})
+		}
+	}
+	for _, fr := range env.faults.list() {
+		if written(fr.Path) {
+			entries = append(entries, snapshotEntry{Fault: fr})
+		}
+	}
+	for _, pr := range env.proxies.list() {
+		if written(pr.Prefix) {
+			entries = append(entries, snapshotEntry{Proxy: pr})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	for _, e := range append(entries, found...) {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshot reads a whole snapshot, so a broken one is rejected before anything is restored
+func readSnapshot(r io.Reader) ([]snapshotEntry, error) {
+	var entries []snapshotEntry
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var e snapshotEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot entry %d: %v", line, err)
+		}
+		switch {
+		case e.Bin != nil:
+			if e.Bin.ID == "" || strings.Contains(e.Bin.ID, "/") {
+				return nil, fmt.Errorf("snapshot entry %d: invalid bin id: %q", line, e.Bin.ID)
+			}
+		case e.Response != nil:
+			err = e.Response.compile()
+		case e.Fault != nil:
+			err = e.Fault.compile()
+		case e.Proxy != nil:
+			err = e.Proxy.compile()
+		case e.Request != nil:
+			if !strings.HasPrefix(e.Path, "/") || e.Request.ID == "" {
+				return nil, fmt.Errorf("snapshot entry %d: a request needs a path and an id", line)
+			}
+		default:
+			return nil, fmt.Errorf("snapshot entry %d: neither a bin, a rule nor a request", line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot entry %d: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// restoreSnapshot adds the entries to env, skipping requests it already has. The rules replace the ones set
+// for the same path and method, or prefix, they are only restored when rules is set. It returns the paths
+// that requests were restored on.
+func restoreSnapshot(env *captureEnv, entries []snapshotEntry, rules bool) (ImportResult, []string) {
+	res := ImportResult{}
+	stored := map[string]bool{}
+	env.store.foreach(func(key string, values []*CapturedRequest) bool {
+		for _, v := range values {
+			stored[v.ID] = true
+		}
+		return true
+	})
+	paths := []string{}
+	restored := map[string]bool{}
+	for _, e := range entries {
+		switch {
+		case e.Bin != nil:
+			if env.bins.restore(*e.Bin) {
+				res.Bins++
+			}
+		case e.Request == nil && !rules:
+			res.SkippedRules++
+		case e.Response != nil:
+			env.responses.set(e.Response)
+			res.Rules++
+		case e.Fault != nil:
+			env.faults.set(e.Fault)
+			res.Rules++
+		case e.Proxy != nil:
+			env.proxies.set(e.Proxy)
+			res.Rules++
+		case stored[e.Request.ID]:
+			res.Skipped++
+		default:
+			env.store.append(e.Path, e.Request)
+			stored[e.Request.ID] = true
+			res.Requests++
+			if !restored[e.Path] {
+				restored[e.Path] = true
+				paths = append(paths, e.Path)
+			}
+		}
+	}
+	return res, paths
+}
+
+// restore imports a snapshot into the running flytrap, the restored paths expire like freshly captured ones
+func (e *captureEnv) restore(entries []snapshotEntry, replace bool, handlers *sync.Map) ImportResult {
+	if replace {
+		for _, b := range e.bins.list() {
+			e.deleteBin(b.ID, handlers)
+		}
+		// the snapshot brings its own rules, the ones outside bins go as well
+		e.responses.removePrefix("")
+		e.faults.removePrefix("")
+		e.proxies.removePrefix("")
+		handlers.Range(func(key, value interface{}) bool {
+			handlers.Delete(key)
+			return true
+		})
+		e.store.foreach(func(key string, values []*CapturedRequest) bool {
+			e.store.delete(key)
+			return true
+		})
+	}
+	res, paths := restoreSnapshot(e, entries, true)
+	for _, path := range paths {
+		handlers.LoadOrStore(path, newexpiringHandler(path, e))
+	}
+	e.notifier.notify()
+	return res
+}
+
+// Import restores a snapshot written by flytrap export --format jsonl
+func Import(opts ImportOptions, r io.Reader) (ImportResult, error) {
+	if opts.URL != "" {
+		return importTo(opts, r)
+	}
+	entries, err := readSnapshot(r)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	store, err := openDiskStore(opts.DataDir)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("opening the disk store (use --url to import into a running flytrap): %w", err)
+	}
+	defer store.close()
+	env := newCaptureEnv(store, "")
+	if env.bins, err = openBinRegistry(filepath.Join(opts.DataDir, binsFile)); err != nil {
+		return ImportResult{}, err
+	}
+	if opts.Replace {
+		for _, b := range env.bins.list() {
+			env.bins.remove(b.ID)
+		}
+		store.foreach(func(key string, values []*CapturedRequest) bool {
+			store.delete(key)
+			return true
+		})
+	}
+	// rules only live in a running flytrap, they are counted as skipped
+	res, _ := restoreSnapshot(env, entries, false)
+	return res, nil
+}
+
+// importTo uploads the snapshot to the query server of a running flytrap
+func importTo(opts ImportOptions, r io.Reader) (ImportResult, error) {
+	u := strings.TrimSuffix(opts.URL, "/") + "/api/v1/import"
+	if opts.Replace {
+		u += "?" + url.Values{"replace": {"true"}}.Encode()
+	}
+	resp, err := http.Post(u, "application/x-ndjson", r)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var ae apiError
+		json.NewDecoder(resp.Body).Decode(&ae)
+		return ImportResult{}, fmt.Errorf("import into %s failed: %s %s", opts.URL, resp.Status, ae.Error)
+	}
+	var res ImportResult
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// registerSnapshotAPI adds the endpoints that dump the store as json lines and restore such a dump,
+// the export is filtered like wait plus until and bin
+func registerSnapshotAPI(mux *http.ServeMux, env *captureEnv, handlers *sync.Map) {
+	mux.HandleFunc("GET /api/v1/export.jsonl", func(w http.ResponseWriter, r *http.Request) {
+		m, err := newRequestMatcher(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="flytrap.jsonl"`)
+		if err := writeSnapshot(w, m, len(r.URL.Query()) > 0, env); err != nil {
+			log.Printf("Error writing snapshot: %v", err)
+		}
+	})
+
+	// restores a snapshot, ?replace=true drops everything stored before
+	mux.HandleFunc("POST /api/v1/import", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := readSnapshot(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, env.restore(entries, r.URL.Query().Get("replace") == "true", handlers))
+	})
+}
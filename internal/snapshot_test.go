@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// snapshotEnv has a bin with a response, fault and proxy of its own, a global fault, and a request in and outside the bin
+func snapshotEnv(t *testing.T) (*captureEnv, bin) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	b := env.bins.create("team-a", 0)
+	for _, err := range []error{
+		env.responses.set(&mockResponse{Path: b.prefix() + "hi", Status: 201}),
+		env.faults.set(&faultRule{Path: b.prefix() + "slow", Status: 503}),
+		env.faults.set(&faultRule{Path: "/global", Status: 500}),
+		env.proxies.set(&proxyRule{Prefix: b.prefix() + "up/", Upstream: "http://localhost:8080"}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.store.append(b.prefix()+"hi", testRequest("in-bin"))
+	env.store.append("/plain", testRequest("plain"))
+	return env, *b
+}
+
+func snapshot(t *testing.T, env *captureEnv, filter url.Values) []snapshotEntry {
+	m, err := newRequestMatcher(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, m, len(filter) > 0, env); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	env, b := snapshotEnv(t)
+	entries := snapshot(t, env, nil)
+
+	to := newCaptureEnv(newMemStore(), "9000")
+	res := to.restore(entries, false, &sync.Map{})
+	if res != (ImportResult{Bins: 1, Rules: 4, Requests: 2}) {
+		t.Errorf("got %+v, want 1 bin, 4 rules and 2 requests", res)
+	}
+	if _, ok := to.bins.get(b.ID); !ok {
+		t.Error("the bin was not restored")
+	}
+	if mr := to.responses.get(b.prefix()+"hi", ""); mr == nil || mr.Status != 201 {
+		t.Errorf("got response %+v, want the one of the bin", mr)
+	}
+	if fr := to.faults.lookup("/global", "GET"); fr == nil || fr.Status != 500 {
+		t.Errorf("got fault %+v, want the global one", fr)
+	}
+	if pr := to.proxies.lookup(b.prefix() + "up/x"); pr == nil || pr.target == nil {
+		t.Errorf("got proxy %+v, want the compiled one of the bin", pr)
+	}
+	if len(to.store.load("/plain")) != 1 || len(to.store.load(b.prefix()+"hi")) != 1 {
+		t.Error("the requests were not restored")
+	}
+
+	// importing again only replaces the rules
+	if res := to.restore(entries, false, &sync.Map{}); res != (ImportResult{Rules: 4, Skipped: 2}) {
+		t.Errorf("got %+v on the second import, want 4 rules and 2 skipped requests", res)
+	}
+}
+
+func TestSnapshotReplaceDropsRules(t *testing.T) {
+	env, b := snapshotEnv(t)
+	entries := snapshot(t, env, url.Values{"bin": {b.ID}})
+
+	to := newCaptureEnv(newMemStore(), "9000")
+	for _, err := range []error{
+		to.responses.set(&mockResponse{Path: "/old", Status: 202}),
+		to.faults.set(&faultRule{Path: "/old", Status: 500}),
+		to.proxies.set(&proxyRule{Prefix: "/old/", Upstream: "http://localhost:8080"}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	to.restore(entries, true, &sync.Map{})
+	if to.responses.get("/old", "") != nil || to.faults.lookup("/old", "GET") != nil || to.proxies.lookup("/old/x") != nil {
+		t.Error("rules set before a replacing import are still there")
+	}
+	if len(to.responses.list()) != 1 || len(to.faults.list()) != 1 || len(to.proxies.list()) != 1 {
+		t.Error("the rules of the snapshot were not restored")
+	}
+}
+
+func TestSnapshotFiltered(t *testing.T) {
+	env, b := snapshotEnv(t)
+	var bins, rules, requests int
+	for _, e := range snapshot(t, env, url.Values{"bin": {b.ID}}) {
+		switch {
+		case e.Bin != nil:
+			bins++
+		case e.Request != nil:
+			requests++
+		default:
+			rules++
+		}
+		if e.Fault != nil && e.Fault.Path == "/global" {
+			t.Error("a filtered snapshot has a rule outside its bins")
+		}
+	}
+	if bins != 1 || rules != 3 || requests != 1 {
+		t.Errorf("got %d bins, %d rules and %d requests, want the bin with its 3 rules and request", bins, rules, requests)
+	}
+}
+
+func TestImportDiskStore(t *testing.T) {
+	env, b := snapshotEnv(t)
+	m, _ := newRequestMatcher(nil)
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, m, false, env); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	res, err := Import(ImportOptions{DataDir: dir}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ImportResult{Bins: 1, Requests: 2, SkippedRules: 4}) {
+		t.Errorf("got %+v, want 1 bin, 2 requests and 4 skipped rules", res)
+	}
+	// flytrap finds the bin when it starts on the data dir
+	bins, err := openBinRegistry(filepath.Join(dir, binsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := bins.get(b.ID); !ok || got.Owner != "team-a" {
+		t.Errorf("got bin %+v, want the imported one", got)
+	}
+	store, err := readDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.load(b.prefix()+"hi")) != 1 {
+		t.Error("the request of the bin was not stored")
+	}
+}
+
+func TestImportRefusesRunningStore(t *testing.T) {
+	dir := t.TempDir()
+	running, err := openDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(ImportOptions{DataDir: dir}, strings.NewReader("")); !errors.Is(err, errDirLocked) {
+		t.Errorf("got %v importing into the store of a running flytrap, want %v", err, errDirLocked)
+	}
+	running.close()
+	if _, err := Import(ImportOptions{DataDir: dir}, strings.NewReader("")); err != nil {
+		t.Errorf("got %v once the store was closed", err)
+	}
+}
@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// snippetFormats render a captured request as something that sends it again.
+// Bodies are sent byte for byte, except multipart forms of plain fields which become form fields.
+var snippetFormats = map[string]func(u string, cr *CapturedRequest) string{
+	"curl":   curlSnippet,
+	"httpie": httpieSnippet,
+	"go":     goSnippet,
+}
+
+// snippetSkipHeaders are recomputed by every client from the body it sends
+var snippetSkipHeaders = map[string]bool{"Content-Length": true, "Host": true}
+
+// snippetURL is where the request was sent, or the same path and query on target, eg: http://localhost:8080
+func snippetURL(target string, cr *CapturedRequest) (string, error) {
+	if target == "" {
+		return harURL(cr), nil
+	}
+	t, err := url.Parse(target)
+	if err != nil || t.Scheme == "" || t.Host == "" {
+		return "", fmt.Errorf("invalid target: %q (use an absolute url, eg: http://localhost:8080)", target)
+	}
+	u := cr.URL()
+	u.Scheme, u.Host = t.Scheme, t.Host
+	return u.String(), nil
+}
+
+// snippetHeaders lists the headers to send, sorted by name, without the ones in skip
+func snippetHeaders(h http.Header, skip map[string]bool) []harNameValue {
+	var nvs []harNameValue
+	for _, nv := range harHeaders(h) {
+		if !snippetSkipHeaders[nv.Name] && !skip[nv.Name] {
+			nvs = append(nvs, nv)
+		}
+	}
+	return nvs
+}
+
+type formField struct {
+	name, value string
+}
+
+// textForm reads a multipart body made only of plain text fields, nil if it has files or can't be read
+func textForm(cr *CapturedRequest) []formField {
+	mt, params, err := mime.ParseMediaType(cr.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" || params["boundary"] == "" || cr.BodyTruncated {
+		return nil
+	}
+	mr := multipart.NewReader(bytes.NewReader(cr.Body), params["boundary"])
+	fields := []formField{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return fields
+		}
+		if err != nil || part.FileName() != "" || part.FormName() == "" {
+			return nil
+		}
+		value, err := io.ReadAll(part)
+		if err != nil || !utf8.Valid(value) || bytes.IndexByte(value, 0) >= 0 {
+			return nil
+		}
+		fields = append(fields, formField{part.FormName(), string(value)})
+	}
+}
+
+// isText tells if a body can be written inside a shell argument
+func isText(body []byte) bool {
+	return utf8.Valid(body) && bytes.IndexByte(body, 0) < 0
+}
+
+// shellQuote quotes s for posix shells, single quotes inside are closed, escaped and reopened
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// base64Pipe is a shell pipeline writing a binary body to stdin of the command that follows
+func base64Pipe(body []byte) string {
+	return "printf '%s' " + shellQuote(base64.StdEncoding.EncodeToString(body)) + " | base64 -d | "
+}
+
+func curlSnippet(u string, cr *CapturedRequest) string {
+	form := textForm(cr)
+	skip := map[string]bool{}
+	if form != nil {
+		// curl picks its own boundary
+		skip["Content-Type"] = true
+	}
+	var b strings.Builder
+	args := []string{"curl"}
+	// curl sends a GET, or a POST when there is a body, unless told otherwise
+	implied := http.MethodGet
+	if len(cr.Body) > 0 {
+		implied = http.MethodPost
+	}
+	switch cr.Method {
+	case implied:
+	case http.MethodHead:
+		args = append(args, "--head")
+	default:
+		args = append(args, "-X", cr.Method)
+	}
+	if strings.HasPrefix(cr.Proto, "HTTP/2") {
+		if strings.HasPrefix(u, "https:") {
+			args = append(args, "--http2")
+		} else {
+			args = append(args, "--http2-prior-knowledge")
+		}
+	}
+	args = append(args, shellQuote(u))
+	for _, h := range snippetHeaders(cr.Header, skip) {
+		if h.Value == "" {
+			// curl removes headers given an empty value, name; sends one
+			args = append(args, "-H", shellQuote(h.Name+";"))
+		} else {
+			args = append(args, "-H", shellQuote(h.Name+": "+h.Value))
+		}
+	}
+	switch {
+	case form != nil:
+		for _, f := range form {
+			args = append(args, "--form-string", shellQuote(f.name+"="+f.value))
+		}
+	case len(cr.Body) == 0:
+	case isText(cr.Body):
+		args = append(args, "--data-raw", shellQuote(string(cr.Body)))
+	default:
+		b.WriteString(base64Pipe(cr.Body))
+		args = append(args, "--data-binary", "@-")
+	}
+	b.WriteString(strings.Join(args, " "))
+	return b.String()
+}
+
+func httpieSnippet(u string, cr *CapturedRequest) string {
+	form := textForm(cr)
+	skip := map[string]bool{}
+	if form != nil {
+		skip["Content-Type"] = true
+	}
+	var b strings.Builder
+	args := []string{"http"}
+	switch {
+	case form != nil:
+		args = append(args, "--multipart")
+	case len(cr.Body) > 0 && isText(cr.Body):
+		args = append(args, "--raw", shellQuote(string(cr.Body)))
+	}
+	args = append(args, cr.Method, shellQuote(u))
+	for _, h := range snippetHeaders(cr.Header, skip) {
+		if h.Value == "" {
+			// httpie drops headers given an empty value, name; sends one
+			args = append(args, shellQuote(httpieEscape(h.Name)+";"))
+		} else {
+			args = append(args, shellQuote(httpieEscape(h.Name)+":"+h.Value))
+		}
+	}
+	switch {
+	case form != nil:
+		for _, f := range form {
+			args = append(args, shellQuote(httpieEscape(f.name)+"="+f.value))
+		}
+	case len(cr.Body) > 0 && !isText(cr.Body):
+		// httpie sends stdin as the body
+		b.WriteString(base64Pipe(cr.Body))
+	}
+	b.WriteString(strings.Join(args, " "))
+	return b.String()
+}
+
+// httpieEscape escapes the characters httpie reads as separators in the key of a request item
+func httpieEscape(key string) string {
+	var b strings.Builder
+	for _, c := range key {
+		if strings.ContainsRune(`:=@;\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func goSnippet(u string, cr *CapturedRequest) string {
+	var b strings.Builder
+	imports := []string{"fmt", "io", "log", "net/http"}
+	body := "nil"
+	if len(cr.Body) > 0 {
+		imports = append(imports, "bytes")
+		body = "bytes.NewReader(body)"
+	}
+	sort.Strings(imports)
+	b.WriteString("package main\n\nimport (\n")
+	for _, imp := range imports {
+		fmt.Fprintf(&b, "\t%q\n", imp)
+	}
+	b.WriteString(")\n\nfunc main() {\n")
+	if len(cr.Body) > 0 {
+		fmt.Fprintf(&b, "\tbody := []byte(%s)\n", strconv.Quote(string(cr.Body)))
+	}
+	fmt.Fprintf(&b, "\treq, err := http.NewRequest(%q, %q, %s)\n", cr.Method, u, body)
+	b.WriteString("\tif err != nil {\n\t\tlog.Fatal(err)\n\t}\n")
+	for _, h := range snippetHeaders(cr.Header, nil) {
+		fmt.Fprintf(&b, "\treq.Header.Add(%q, %q)\n", h.Name, h.Value)
+	}
+	b.WriteString("\tresp, err := http.DefaultClient.Do(req)\n")
+	b.WriteString("\tif err != nil {\n\t\tlog.Fatal(err)\n\t}\n")
+	b.WriteString("\tdefer resp.Body.Close()\n")
+	b.WriteString("\trespBody, err := io.ReadAll(resp.Body)\n")
+	b.WriteString("\tif err != nil {\n\t\tlog.Fatal(err)\n\t}\n")
+	b.WriteString("\tfmt.Println(resp.Status)\n")
+	b.WriteString("\tfmt.Println(string(respBody))\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// registerSnippetAPI adds the endpoint that renders a stored request as a curl, httpie or go snippet,
+// eg: /api/v1/requests/{id}/curl?target=http://localhost:8080 to send it to localhost instead
+func registerSnippetAPI(mux *http.ServeMux, store storage) {
+	mux.HandleFunc("GET /api/v1/requests/{id}/{format}", func(w http.ResponseWriter, r *http.Request) {
+		render, ok := snippetFormats[r.PathValue("format")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown snippet format: "+r.PathValue("format")+" (use curl, httpie or go)")
+			return
+		}
+		_, cr := findRequest(store, r.PathValue("id"))
+		if cr == nil {
+			writeError(w, http.StatusNotFound, "no request with id: "+r.PathValue("id"))
+			return
+		}
+		u, err := snippetURL(r.URL.Query().Get("target"), cr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		snippet := render(u, cr)
+		if !strings.HasSuffix(snippet, "\n") {
+			snippet += "\n"
+		}
+		if cr.BodyTruncated {
+			comment := "# "
+			if r.PathValue("format") == "go" {
+				comment = "// "
+			}
+			snippet = fmt.Sprintf("%sonly the first %d of the %d body bytes were kept\n", comment, len(cr.Body), cr.BodySize) + snippet
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, snippet)
+	})
+}
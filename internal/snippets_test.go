@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// shellArgs runs the snippet with its command swapped for one printing the arguments the shell gave it
+func shellArgs(t *testing.T, snippet, command string) []string {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run the snippet")
+	}
+	out, err := exec.Command(sh, "-c", strings.Replace(snippet, command, `printf '%s\n'`, 1)).Output()
+	if err != nil {
+		t.Fatalf("%v running %s", err, snippet)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
+
+func snippetRequest(method, body string) *CapturedRequest {
+	cr := &CapturedRequest{Method: method, Path: "/x", RawQuery: "q=it's&a=$b", Host: "example.com", Proto: "HTTP/1.1",
+		Header: http.Header{}, Body: []byte(body)}
+	cr.Header.Set("X-Quote", `it's "quoted" $HOME`)
+	cr.Header.Set("Content-Length", "42")
+	return cr
+}
+
+func TestCurlSnippetQuoting(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cr   *CapturedRequest
+		want []string
+	}{
+		{"get", snippetRequest("GET", ""),
+			[]string{"http://example.com/x?q=it's&a=$b", "-H", `X-Quote: it's "quoted" $HOME`}},
+		{"implied post", snippetRequest("POST", "don't `run` $(this)\nor 'that'"),
+			[]string{"http://example.com/x?q=it's&a=$b", "-H", `X-Quote: it's "quoted" $HOME`, "--data-raw", "don't `run` $(this)"}},
+		{"put", snippetRequest("PUT", "{}"),
+			[]string{"-X", "PUT", "http://example.com/x?q=it's&a=$b", "-H", `X-Quote: it's "quoted" $HOME`, "--data-raw", "{}"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := shellArgs(t, curlSnippet(harURL(tc.cr), tc.cr), "curl")
+			// the body is the only argument spanning lines, its second line comes out on its own
+			if tc.name == "implied post" {
+				if len(got) < 2 || got[len(got)-1] != "or 'that'" {
+					t.Fatalf("got %q, want the whole body", got)
+				}
+				got = got[:len(got)-1]
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got arguments %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSnippetBinaryBody(t *testing.T) {
+	for _, tool := range []string{"sh", "base64"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip("no " + tool + " to run the pipe")
+		}
+	}
+	body := "\x00\xff binary 'body'"
+	cr := snippetRequest("POST", body)
+	for format, command := range map[string]string{"curl": "curl", "httpie": "http"} {
+		// the command is swapped for cat, and the rest of its line made a comment, to see what the pipe writes to it
+		snippet := snippetFormats[format](harURL(cr), cr)
+		out, err := exec.Command("sh", "-c", strings.Replace(snippet, command+" ", "cat # ", 1)).Output()
+		if err != nil {
+			t.Fatalf("%s: %v running %s", format, err, snippet)
+		}
+		if string(out) != body {
+			t.Errorf("%s: the pipe wrote %q, want %q", format, out, body)
+		}
+	}
+}
+
+func TestHTTPieSnippetQuoting(t *testing.T) {
+	cr := snippetRequest("PATCH", "it's")
+	cr.Header.Set("X-Empty", "")
+	cr.Header["X-Odd:Name"] = []string{"v"}
+	got := shellArgs(t, httpieSnippet(harURL(cr), cr), "http")
+	want := []string{"--raw", "it's", "PATCH", "http://example.com/x?q=it's&a=$b", "X-Empty;", `X-Odd\:Name:v`, `X-Quote:it's "quoted" $HOME`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got arguments %q, want %q", got, want)
+	}
+}
+
+func TestGoSnippet(t *testing.T) {
+	cr := snippetRequest("POST", "line \"one\"\n\x00two")
+	snippet := goSnippet("http://localhost:8080/x", cr)
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", snippet, 0); err != nil {
+		t.Fatalf("%v in %s", err, snippet)
+	}
+	for _, want := range []string{`"line \"one\"\n\x00two"`, `http.NewRequest("POST", "http://localhost:8080/x", bytes.NewReader(body))`,
+		`req.Header.Add("X-Quote", "it's \"quoted\" $HOME")`} {
+		if !strings.Contains(snippet, want) {
+			t.Errorf("the snippet has no %s:\n%s", want, snippet)
+		}
+	}
+	if strings.Contains(snippet, "Content-Length") {
+		t.Error("the snippet sets the Content-Length")
+	}
+}
+
+func TestSnippetAPI(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	cr := snippetRequest("POST", "hi")
+	cr.ID = "snip"
+	env.store.append("/x", cr)
+	srv := apiServer(t, env)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/snip/curl?target=http://localhost:8080", http.StatusOK, `curl 'http://localhost:8080/x?q=it'\''s&a=$b'`},
+		{"/snip/httpie", http.StatusOK, `http --raw 'hi' POST`},
+		{"/snip/curl?target=localhost", http.StatusBadRequest, ""},
+		{"/snip/wget", http.StatusNotFound, ""},
+		{"/nope/curl", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get(srv.URL + "/api/v1/requests" + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || !strings.Contains(string(body), tc.want) {
+			t.Errorf("%s: got %d %s, want %d with %s", tc.path, resp.StatusCode, body, tc.status, tc.want)
+		}
+	}
+}
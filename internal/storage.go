@@ -1,55 +1,188 @@
 package internal
 
-import "log"
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+)
 
+// Storage backends that can be selected with Config.Store
+const (
+	StoreMemory = "memory"
+	StoreDisk   = "disk"
+)
+
+// DefaultDataDir is where the disk store keeps its segments when no directory is configured
+const DefaultDataDir = "flytrap-data"
+
+// storage holds the captured requests by path.
+// Implementations must be safe for concurrent use, values returned are snapshots
+// that the store will not modify afterwards.
 type storage interface {
-	append(key string, value interface{})
+	append(key string, value *CapturedRequest)
+	update(key string, value *CapturedRequest) bool // replaces the stored request with the same id
 	exists(key string) bool
-	load(key string) []interface{}
-	foreach(func(key string, value []interface{}) bool)
+	load(key string) []*CapturedRequest
+	foreach(func(key string, value []*CapturedRequest) bool)
 	delete(key string) bool
+	remove(key string, ids ...string) int // removes single requests, a key left empty is deleted
 }
 
+// newStorage creates the storage backend of the given kind, dir is only used by the disk store
+func newStorage(kind, dir string) (storage, error) {
+	switch kind {
+	case "", StoreMemory:
+		return newMemStore(), nil
+	case StoreDisk:
+		if dir == "" {
+			dir = DefaultDataDir
+		}
+		return newDiskStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown store: %s (use %s or %s)", kind, StoreMemory, StoreDisk)
+	}
+}
+
+// memStoreShards is the number of independently locked partitions of a memStore
+const memStoreShards = 32
+
+// memStore keeps requests in memory, split into shards by key so captures on different paths rarely contend
 type memStore struct {
-	data map[string][]interface{}
+	shards [memStoreShards]memStoreShard
+}
+
+type memStoreShard struct {
+	sync.RWMutex
+	data map[string][]*CapturedRequest
 }
 
 func newMemStore() storage {
-	return &memStore{data: make(map[string][]interface{})}
+	ms := &memStore{}
+	for i := range ms.shards {
+		ms.shards[i].data = make(map[string][]*CapturedRequest)
+	}
+	return ms
+}
+
+func (ms *memStore) shard(key string) *memStoreShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &ms.shards[h.Sum32()%memStoreShards]
+}
+
+func (ms *memStore) append(key string, value *CapturedRequest) {
+	s := ms.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	s.data[key] = append(s.data[key], value)
 }
 
-func (ms *memStore) append(key string, value interface{}) {
-	vals, ok := ms.data[key]
-	if !ok {
-		vals = []interface{}{}
+func (ms *memStore) update(key string, value *CapturedRequest) bool {
+	s := ms.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	updated, ok := replaceRequest(s.data[key], value)
+	if ok {
+		s.data[key] = updated
 	}
-	vals = append(vals, value)
-	ms.data[key] = vals
+	return ok
 }
 
 func (ms *memStore) exists(key string) bool {
-	_, ok := ms.data[key]
+	s := ms.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.data[key]
 	return ok
 }
 
-func (ms *memStore) load(key string) []interface{} {
-	vals, _ := ms.data[key]
-	return vals
+func (ms *memStore) load(key string) []*CapturedRequest {
+	s := ms.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	return cloneRequests(s.data[key])
 }
 
 func (ms *memStore) delete(key string) bool {
-	_, ok := ms.data[key]
+	s := ms.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.data[key]
 	if ok {
 		log.Printf("Store deleting key: %s", key)
-		delete(ms.data, key)
+		delete(s.data, key)
 	}
 	return ok
 }
 
-func (ms *memStore) foreach(f func(key string, values []interface{}) bool) {
-	for k, v := range ms.data {
-		if !f(k, v) {
-			return
+func (ms *memStore) remove(key string, ids ...string) int {
+	s := ms.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	kept, removed := removeRequests(s.data[key], ids)
+	if removed == 0 {
+		return 0
+	}
+	if len(kept) == 0 {
+		delete(s.data, key)
+	} else {
+		s.data[key] = kept
+	}
+	return removed
+}
+
+// foreach calls f with a snapshot of each shard, without holding any locks,
+// so f is free to call back into the store
+func (ms *memStore) foreach(f func(key string, values []*CapturedRequest) bool) {
+	for i := range ms.shards {
+		s := &ms.shards[i]
+		s.RLock()
+		snapshot := make(map[string][]*CapturedRequest, len(s.data))
+		for k, v := range s.data {
+			snapshot[k] = cloneRequests(v)
+		}
+		s.RUnlock()
+
+		for k, v := range snapshot {
+			if !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func cloneRequests(values []*CapturedRequest) []*CapturedRequest {
+	if values == nil {
+		return nil
+	}
+	return append(make([]*CapturedRequest, 0, len(values)), values...)
+}
+
+// removeRequests returns the values without the requests with the given ids and how many were removed.
+// It never modifies values, so snapshots handed out earlier stay intact.
+func removeRequests(values []*CapturedRequest, ids []string) ([]*CapturedRequest, int) {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	kept := make([]*CapturedRequest, 0, len(values))
+	for _, v := range values {
+		if !drop[v.ID] {
+			kept = append(kept, v)
+		}
+	}
+	return kept, len(values) - len(kept)
+}
+
+// replaceRequest returns a copy of values with the request with the same id as value replaced by it
+func replaceRequest(values []*CapturedRequest, value *CapturedRequest) ([]*CapturedRequest, bool) {
+	for i, v := range values {
+		if v.ID == value.ID {
+			updated := cloneRequests(values)
+			updated[i] = value
+			return updated, true
 		}
 	}
+	return values, false
 }
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	hammerWorkers  = 8
+	hammerRequests = 200
+)
+
+func testRequest(id string) *CapturedRequest {
+	return &CapturedRequest{ID: id, Method: "POST", Path: "/hammer", ReceivedAt: time.Now(), Body: []byte("body of " + id)}
+}
+
+// hammer runs the storage operations concurrently, each worker on a path of its own and on one they all share,
+// while readers walk the store. It is meant to be run with -race.
+func hammer(t *testing.T, s storage, also func()) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.foreach(func(key string, values []*CapturedRequest) bool {
+					for _, v := range values {
+						if v == nil || v.ID == "" {
+							t.Errorf("foreach returned an empty request on %s", key)
+						}
+					}
+					s.exists(key)
+					return true
+				})
+				s.load("/shared")
+				if also != nil {
+					also()
+				}
+			}
+		}()
+	}
+
+	var workers sync.WaitGroup
+	for w := 0; w < hammerWorkers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			own := fmt.Sprintf("/worker/%d", w)
+			for i := 0; i < hammerRequests; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				s.append(own, testRequest(id))
+				s.append("/shared", testRequest("shared-"+id))
+
+				updated := testRequest(id)
+				updated.Response = &CapturedResponse{Status: 200}
+				// fails when a neighbour deleted the path in between
+				s.update(own, updated)
+				switch i % 10 {
+				case 3:
+					s.remove(own, id)
+				case 7:
+					s.remove("/shared", "shared-"+id)
+				case 9:
+					s.delete("/worker/" + fmt.Sprint((w+1)%hammerWorkers))
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	close(done)
+	wg.Wait()
+}
+
+// checkConsistent verifies that every request is stored once and that foreach agrees with load
+func checkConsistent(t *testing.T, s storage) int {
+	seen := map[string]bool{}
+	s.foreach(func(key string, values []*CapturedRequest) bool {
+		if len(values) == 0 {
+			t.Errorf("empty key %s was kept", key)
+		}
+		if loaded := s.load(key); len(loaded) != len(values) {
+			t.Errorf("load of %s returned %d requests, foreach %d", key, len(loaded), len(values))
+		}
+		for _, v := range values {
+			if seen[v.ID] {
+				t.Errorf("request %s is stored twice", v.ID)
+			}
+			seen[v.ID] = true
+		}
+		return true
+	})
+	return len(seen)
+}
+
+func TestMemStoreConcurrent(t *testing.T) {
+	s := newMemStore()
+	hammer(t, s, nil)
+	checkConsistent(t, s)
+	// every worker appended to the shared path and removed a tenth of what it put there
+	if got, want := len(s.load("/shared")), hammerWorkers*hammerRequests*9/10; got != want {
+		t.Errorf("shared path has %d requests, want %d", got, want)
+	}
+}
+
+func TestDiskStoreConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := newDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compact now and then while the store is being written to
+	stop := make(chan struct{})
+	var compactions sync.WaitGroup
+	compactions.Add(1)
+	go func() {
+		defer compactions.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if err := ds.compact(); err != nil {
+				t.Errorf("compact: %v", err)
+			}
+		}
+	}()
+	hammer(t, ds, nil)
+	close(stop)
+	compactions.Wait()
+	stored := checkConsistent(t, ds)
+
+	// replaying the segments gives back what is in memory
+	replayed, err := readDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := checkConsistent(t, replayed); got != stored {
+		t.Errorf("replay has %d requests, the store %d", got, stored)
+	}
+	ds.foreach(func(key string, values []*CapturedRequest) bool {
+		loaded := replayed.load(key)
+		if len(loaded) != len(values) {
+			t.Errorf("replay has %d requests on %s, the store %d", len(loaded), key, len(values))
+			return true
+		}
+		for i, v := range values {
+			if loaded[i].ID != v.ID || (loaded[i].Response == nil) != (v.Response == nil) {
+				t.Errorf("replay of %s differs on %s", v.ID, key)
+			}
+		}
+		return true
+	})
+}
+
+func TestBoundedStoreConcurrent(t *testing.T) {
+	limits := RetentionLimits{MaxRequestsPerPath: 50, MaxTotalBytes: 64 << 10, MaxBodyBytes: 8}
+	bs := newBoundedStore(newMemStore(), limits)
+	hammer(t, bs, func() { bs.retentionStats() })
+	stored := checkConsistent(t, bs)
+
+	stats := bs.retentionStats()
+	if stats.Requests != stored {
+		t.Errorf("retention counts %d requests, the store holds %d", stats.Requests, stored)
+	}
+	if stats.Bytes > limits.MaxTotalBytes {
+		t.Errorf("the store holds %d bytes, over the limit of %d", stats.Bytes, limits.MaxTotalBytes)
+	}
+	bs.foreach(func(key string, values []*CapturedRequest) bool {
+		if len(values) > limits.MaxRequestsPerPath {
+			t.Errorf("%s holds %d requests, over the limit of %d", key, len(values), limits.MaxRequestsPerPath)
+		}
+		for _, v := range values {
+			if len(v.Body) > int(limits.MaxBodyBytes) {
+				t.Errorf("request %s kept a body of %d bytes", v.ID, len(v.Body))
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// streamScript makes a mock response stream its body, either as server sent events or as plain chunks,
+// waiting for each item's delay before sending it. With KeepOpen the response only ends when the client leaves.
+type streamScript struct {
+	Events   []sseEvent    `json:"events,omitempty"`
+	Chunks   []streamChunk `json:"chunks,omitempty"`
+	KeepOpen bool          `json:"keepOpen,omitempty"`
+}
+
+type sseEvent struct {
+	Event string   `json:"event,omitempty"`
+	ID    string   `json:"id,omitempty"`
+	Data  string   `json:"data"`
+	Retry int      `json:"retry,omitempty"` // reconnection time in milliseconds
+	Delay duration `json:"delay,omitempty"`
+}
+
+type streamChunk struct {
+	Data  string   `json:"data"`
+	Delay duration `json:"delay,omitempty"`
+}
+
+func (ss *streamScript) compile() error {
+	if len(ss.Events) > 0 && len(ss.Chunks) > 0 {
+		return errors.New("a stream has either events or chunks, not both")
+	}
+	for _, ev := range ss.Events {
+		if strings.ContainsAny(ev.Event+ev.ID, "\r\n") {
+			return fmt.Errorf("sse event names and ids can't contain newlines: %q", ev.Event+ev.ID)
+		}
+	}
+	return nil
+}
+
+// format renders the event in the text/event-stream format, every line of the data gets its own data field
+func (ev sseEvent) format() string {
+	var b strings.Builder
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry)
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(ev.Data, "\r\n", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// write streams the response, flushing after every event or chunk.
+// It returns how many events or chunks were sent, and true if the client disconnected before the stream ended.
+func (ss *streamScript) write(ctx context.Context, w http.ResponseWriter, mr *mockResponse) (delivered int, disconnected bool) {
+	if len(ss.Events) > 0 {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	for name, value := range mr.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(mr.Status)
+	rc := http.NewResponseController(w)
+	if rc.Flush() != nil {
+		return 0, ctx.Err() != nil
+	}
+
+	send := func(delay duration, data string) bool {
+		if delay > 0 {
+			select {
+			case <-time.After(time.Duration(delay)):
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	for _, ev := range ss.Events {
+		if !send(ev.Delay, ev.format()) {
+			return delivered, true
+		}
+		delivered++
+	}
+	for _, c := range ss.Chunks {
+		if !send(c.Delay, c.Data) {
+			return delivered, true
+		}
+		delivered++
+	}
+	if ss.KeepOpen {
+		<-ctx.Done()
+		return delivered, true
+	}
+	return delivered, false
+}
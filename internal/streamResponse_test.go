@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureServer serves path the way the capture port does and hands over each request once it is complete
+func captureServer(t *testing.T, env *captureEnv, path string) (*httptest.Server, chan *CapturedRequest) {
+	completed := completions(t, env)
+	srv := httptest.NewServer(newexpiringHandler(path, env))
+	t.Cleanup(srv.Close)
+	return srv, completed
+}
+
+// completions hands over each request captured in env once flytrap is done replying to it
+func completions(t *testing.T, env *captureEnv) chan *CapturedRequest {
+	filter, _ := newRequestMatcher(nil)
+	sub := env.broker.subscribe(filter)
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		env.broker.unsubscribe(sub)
+	})
+	completed := make(chan *CapturedRequest, 1)
+	go func() {
+		for {
+			select {
+			case ev := <-sub.events:
+				if ev.kind == eventResponse {
+					completed <- ev.request
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return completed
+}
+
+func waitCompleted(t *testing.T, completed chan *CapturedRequest) *CapturedRequest {
+	select {
+	case cr := <-completed:
+		return cr
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not completed")
+		return nil
+	}
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	err := env.responses.set(&mockResponse{Path: "/events", Status: http.StatusOK, Stream: &streamScript{
+		Events:   []sseEvent{{Data: "one"}, {Data: "two"}, {Data: "never", Delay: duration(time.Hour)}},
+		KeepOpen: true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, completed := captureServer(t, env, "/events")
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(resp.Body)
+	for read := 0; read < 2; {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			read++
+		}
+	}
+	left := time.Now()
+	resp.Body.Close()
+
+	got := waitCompleted(t, completed).Response
+	if got == nil || !got.Disconnected || got.Delivered != 2 {
+		t.Fatalf("got %+v, want a disconnected response with 2 events delivered", got)
+	}
+	if got.DisconnectedAt == nil || got.DisconnectedAt.Before(left) {
+		t.Errorf("got disconnected at %v, want after the client left at %v", got.DisconnectedAt, left)
+	}
+}
+
+func TestStreamDeliveredInFull(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	err := env.responses.set(&mockResponse{Path: "/download", Status: http.StatusOK, Stream: &streamScript{
+		Chunks: []streamChunk{{Data: "part one\n"}, {Data: "part two\n"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, completed := captureServer(t, env, "/download")
+	resp, err := http.Get(srv.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := waitCompleted(t, completed).Response; got.Disconnected || got.DisconnectedAt != nil || got.Delivered != 2 {
+		t.Errorf("got %+v, want both chunks delivered without a disconnect", got)
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// templateFuncs are the helpers available to response templates, eg:
+// {{ hmac "sha256" "secret" .Body | hex }} or {{ jsonPath .JSON "event.challenge" | json }}
+var templateFuncs = template.FuncMap{
+	"hmac":         hmacSum,
+	"hex":          func(s string) string { return hex.EncodeToString([]byte(s)) },
+	"base64":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"base64URL":    func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) },
+	"base64Decode": base64Decode,
+	"json":         toJSON,
+	"jsonPath":     jsonPath,
+	"uuid":         func() string { return uuid.New().String() },
+	"now":          time.Now,
+	"unix":         func(t time.Time) int64 { return t.Unix() },
+	"unixMilli":    func(t time.Time) int64 { return t.UnixMilli() },
+	"rfc3339":      func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}
+
+var hmacHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hmacSum returns the raw mac of data, pipe it through hex or base64 to print it
+func hmacSum(algorithm, key, data string) (string, error) {
+	h, ok := hmacHashes[strings.ToLower(algorithm)]
+	if !ok {
+		return "", fmt.Errorf("unknown hmac algorithm: %q (use md5, sha1, sha256 or sha512)", algorithm)
+	}
+	mac := hmac.New(h, []byte(key))
+	mac.Write([]byte(data))
+	return string(mac.Sum(nil)), nil
+}
+
+// base64Decode accepts standard and url encodings, padded or not
+func base64Decode(s string) (string, error) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return string(b), nil
+		}
+	}
+	return "", fmt.Errorf("invalid base64: %q", s)
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// parseJSONBody decodes a json request body for templates, numbers are kept as they were written.
+// Bodies that aren't json give nil.
+func parseJSONBody(body []byte) any {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil {
+		return nil
+	}
+	return v
+}
+
+// jsonPath picks a value out of decoded json with a path like $.data.items[0].id or data.items.0.id,
+// keys with dots can be quoted: ["a.b"]. A path that doesn't match gives nil.
+func jsonPath(v any, path string) (any, error) {
+	segments, err := splitJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[seg]
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, nil
+			}
+			v = node[i]
+		default:
+			return nil, nil
+		}
+	}
+	return v, nil
+}
+
+func splitJSONPath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var segments []string
+	for path != "" {
+		switch {
+		case strings.HasPrefix(path, `["`):
+			end := strings.Index(path, `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated key in json path: %q", path)
+			}
+			segments = append(segments, path[2:end])
+			path = path[end+2:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in json path: %q", path)
+			}
+			segments = append(segments, path[1:end])
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			segments = append(segments, path[:end])
+			path = path[end:]
+		}
+		path = strings.TrimPrefix(path, ".")
+	}
+	return segments, nil
+}
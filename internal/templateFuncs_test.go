@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	doc := parseJSONBody([]byte(`{"data": {"items": [{"id": 7}, {"id": 8}]}, "a.b": "dotted", "n": 1.50}`))
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"$.data.items[1].id", "8"},
+		{"data.items.0.id", "7"},
+		{`["a.b"]`, `"dotted"`},
+		{"n", "1.50"}, // numbers are kept as they were written
+		{"data.items[2].id", "null"},
+		{"data.items.x", "null"},
+		{"n.deeper", "null"},
+	} {
+		v, err := jsonPath(doc, tc.path)
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if got, _ := toJSON(v); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.path, got, tc.want)
+		}
+	}
+	for _, path := range []string{`["a.b`, "data[0"} {
+		if _, err := jsonPath(doc, path); err == nil {
+			t.Errorf("%s: got no error for an unterminated path", path)
+		}
+	}
+	if parseJSONBody([]byte("not json")) != nil {
+		t.Error("a body that isn't json was decoded")
+	}
+}
+
+func TestTemplateEncodings(t *testing.T) {
+	mac, err := hmacSum("SHA256", "key", "The quick brown fox jumps over the lazy dog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := templateFuncs["hex"].(func(string) string)(mac); got != "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Errorf("got hmac %s", got)
+	}
+	if _, err := hmacSum("sha3", "key", ""); err == nil {
+		t.Error("got no error for an unknown hmac algorithm")
+	}
+	// the standard and url alphabets, padded or not
+	for _, s := range []string{"Pz8+", "Pz8-", "aGk=", "aGk"} {
+		if _, err := base64Decode(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+	if got, _ := base64Decode("Pz8-"); got != "??>" {
+		t.Errorf("got %q, want ??>", got)
+	}
+	if _, err := base64Decode("not base64!"); err == nil {
+		t.Error("got no error for invalid base64")
+	}
+}
+
+func TestTemplatedResponse(t *testing.T) {
+	mr := &mockResponse{Path: "/slack", Template: true, Status: 201,
+		Headers: map[string]string{"X-Signature": `{{ hmac "sha1" "secret" .Body | base64 }}`},
+		Body:    `{"challenge": {{ jsonPath .JSON "event.challenge" | json }}, "team": "{{ .Query.Get "team" }}", "method": "{{ .Method }}"}`}
+	if err := mr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	cr := testRequest("templated")
+	cr.Path, cr.RawQuery, cr.Body = "/slack", "team=T1", []byte(`{"event": {"challenge": "abc"}}`)
+	rec := httptest.NewRecorder()
+	mr.write(rec, cr)
+
+	var body struct{ Challenge, Team, Method string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if rec.Code != 201 || body.Challenge != "abc" || body.Team != "T1" || body.Method != "POST" {
+		t.Errorf("got %d %+v, want 201 with the challenge, team and method of the request", rec.Code, body)
+	}
+	mac, _ := hmacSum("sha1", "secret", string(cr.Body))
+	if got, want := rec.Header().Get("X-Signature"), templateFuncs["base64"].(func(string) string)(mac); got != want {
+		t.Errorf("got signature %s, want %s", got, want)
+	}
+
+	// a helper failing while the template runs is a 500 that says why
+	mr = &mockResponse{Path: "/bad", Template: true, Body: `{{ base64Decode .Body }}`}
+	if err := mr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	mr.write(rec, testRequest("bad"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want %d for a failing template", rec.Code, http.StatusInternalServerError)
+	}
+	if err := (&mockResponse{Path: "/x", Template: true, Body: "{{ nope }}"}).compile(); err == nil {
+		t.Error("got no error for a template with an unknown helper")
+	}
+}
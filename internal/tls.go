@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxLeafCerts bounds how many generated leaf certificates are cached, clients choose the server names
+const maxLeafCerts = 1024
+
+// The generated CA is kept in the data dir so clients keep trusting it across restarts
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+)
+
+// certAuthority is a self-signed CA that issues a leaf certificate for whatever server name a client asks for,
+// so clients that trust the CA can call the capture port by any host name
+type certAuthority struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+func newCertAuthority() (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"http-flytrap"}, CommonName: "flytrap CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		leaves:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// openCertAuthority loads the CA kept in dir, or generates one and saves it there when dir has none.
+// A CA that is only half there, doesn't parse or has expired is an error rather than replaced,
+// clients may still trust it.
+func openCertAuthority(dir string) (*certAuthority, error) {
+	certPath, keyPath := filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		ca, err := newCertAuthority()
+		if err != nil {
+			return nil, err
+		}
+		return ca, ca.save(certPath, keyPath)
+	}
+	if err := errors.Join(certErr, keyErr); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", certPath, err)
+	}
+	if block, _ = pem.Decode(keyPEM); block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("no EC private key found in %s", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyPath, err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("the key in %s does not belong to the certificate in %s", keyPath, certPath)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("the CA in %s expired on %s, remove it and its key to generate a new one", certPath, cert.NotAfter)
+	}
+	return &certAuthority{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		leaves:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// save writes the key, readable by the owner only, and then the certificate
+func (ca *certAuthority) save(certPath, keyPath string) error {
+	der, err := x509.MarshalECPrivateKey(ca.key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, ca.certPEM, 0o644)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// getCertificate issues, or reuses, a leaf for the server name the client sent.
+// Clients that connect by ip address send no server name, the leaf is then issued for the address they connected to.
+func (ca *certAuthority) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" && hello.Conn != nil {
+		if host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+			name = host
+		}
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if leaf, ok := ca.leaves[name]; ok && time.Now().Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+	leaf, err := ca.issue(name)
+	if err != nil {
+		return nil, fmt.Errorf("issuing certificate for %q: %v", name, err)
+	}
+	if len(ca.leaves) >= maxLeafCerts {
+		clear(ca.leaves)
+	}
+	ca.leaves[name] = leaf
+	return leaf, nil
+}
+
+// issue signs a leaf certificate for the name, localhost and the loopback addresses are always included
+func (ca *certAuthority) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"http-flytrap"}, CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 397),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if name != "" && name != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Client certificate modes that can be selected with Config.TLSClientAuth
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request" // ask for a certificate, requests without one, or with one that fails to verify, are still captured
+	ClientAuthRequire = "require" // refuse connections without a certificate, or with one that fails to verify against the client CA
+)
+
+// configureClientAuth asks clients for certificates and returns the pool to verify them against, if a CA file is given.
+// In request mode certificates are verified after the handshake so invalid ones are recorded rather than refused.
+func configureClientAuth(config *tls.Config, mode, caFile string) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	if caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in client CA file: %s", caFile)
+		}
+		config.ClientCAs = pool
+	}
+	switch mode {
+	case "", ClientAuthNone:
+		if pool != nil {
+			return nil, fmt.Errorf("a client CA needs --tls-client-auth %s or %s", ClientAuthRequest, ClientAuthRequire)
+		}
+	case ClientAuthRequest:
+		config.ClientAuth = tls.RequestClientCert
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAnyClientCert
+		if pool != nil {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	default:
+		return nil, fmt.Errorf("unknown client auth mode: %s (use %s, %s or %s)", mode, ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+	}
+	return pool, nil
+}
+
+// verifyClient checks the client certificates of a request that were not already verified in the handshake
+func (t *TLSInfo) verifyClient(state *tls.ConnectionState, roots *x509.CertPool) {
+	if roots == nil || t.ClientVerified || len(state.PeerCertificates) == 0 {
+		return
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	t.ClientVerified = err == nil
+	if err != nil {
+		t.ClientVerifyError = err.Error()
+	}
+}
+
+// newCaptureTLSConfig serves the cert and key files if they are given, otherwise the self-signed CA kept in dataDir
+// is used, or generated, and returned so it can be handed out to clients
+func newCaptureTLSConfig(certFile, keyFile, dataDir string) (*tls.Config, *certAuthority, error) {
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, nil, fmt.Errorf("both a tls cert and key are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	}
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	ca, err := openCertAuthority(dataDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening CA: %v", err)
+	}
+	return &tls.Config{GetCertificate: ca.getCertificate}, ca, nil
+}
+
+// registerTLSAPI adds the endpoint to download the CA that signs the capture port certificates
+func registerTLSAPI(mux *http.ServeMux, env *captureEnv) {
+	mux.HandleFunc("GET /api/v1/tls/ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		if env.ca == nil {
+			writeError(w, http.StatusNotFound, "flytrap is not generating certificates, tls is off or uses a provided cert")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="flytrap-ca.pem"`)
+		w.Write(env.ca.certPEM)
+	})
+}
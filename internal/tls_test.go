@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsCaptureServer serves path over tls with config, the way the tls capture port does, and returns its address
+func tlsCaptureServer(t *testing.T, env *captureEnv, path string, config *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newexpiringHandler(path, env)}
+	go srv.Serve(tls.NewListener(ln, config))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// trusting is a client that trusts the CA, calling flytrap by serverName
+func trusting(ca *certAuthority, serverName string, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: serverName, Certificates: certs},
+	}}
+}
+
+func TestOpenCertAuthorityReusesTheSavedCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	first, err := openCertAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, caKeyFile)); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("got key file %v %v, want it readable by the owner only", info, err)
+	}
+	second, err := openCertAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.cert.Raw, second.cert.Raw) || !first.key.Equal(second.key) {
+		t.Error("a new CA was generated instead of the saved one")
+	}
+	if !bytes.Equal(first.certPEM, second.certPEM) {
+		t.Error("the CA handed out to clients changed")
+	}
+
+	// a CA missing its key is not replaced, clients may trust it
+	os.Remove(filepath.Join(dir, caKeyFile))
+	if _, err := openCertAuthority(dir); err == nil {
+		t.Error("opened a CA without its key")
+	}
+}
+
+func TestTLSCaptureWithGeneratedCA(t *testing.T) {
+	ca, err := newCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newCaptureEnv(newMemStore(), "9000")
+	env.ca = ca
+	completed := completions(t, env)
+	addr := tlsCaptureServer(t, env, "/hooks", &tls.Config{GetCertificate: ca.getCertificate})
+
+	// any name the client calls flytrap by gets a certificate the CA vouches for, so do addresses
+	for _, tc := range []struct {
+		name, sni string
+	}{
+		{"hooks.example", "hooks.example"},
+		{"localhost", "localhost"},
+		// clients don't send addresses as server names
+		{"127.0.0.1", ""},
+	} {
+		resp, err := trusting(ca, tc.name).Get("https://" + addr + "/hooks")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		got := waitCompleted(t, completed).TLS
+		if got == nil || got.Version == "" || got.CipherSuite == "" || got.ServerName != tc.sni {
+			t.Errorf("%s: got tls %+v, want the connection details with server name %q", tc.name, got, tc.sni)
+		}
+	}
+	if leaf, _ := ca.getCertificate(&tls.ClientHelloInfo{ServerName: "hooks.example"}); leaf != ca.leaves["hooks.example"] {
+		t.Error("the leaf was issued again instead of reused")
+	}
+
+	srv := apiServer(t, env)
+	resp, err := http.Get(srv.URL + "/api/v1/tls/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(pem, ca.certPEM) {
+		t.Errorf("got %q from the CA endpoint, want the CA certificate", pem)
+	}
+	env.ca = nil
+	if status := getJSON(t, srv.URL+"/api/v1/tls/ca.pem", nil); status != http.StatusNotFound {
+		t.Errorf("got status %d without a generated CA, want %d", status, http.StatusNotFound)
+	}
+}
+
+// clientCert is a client certificate for name signed by ca
+func clientCert(t *testing.T, ca *certAuthority, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	var cas [3]*certAuthority
+	for i := range cas {
+		ca, err := newCertAuthority()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cas[i] = ca
+	}
+	serverCA, clientCA, strangerCA := cas[0], cas[1], cas[2]
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	if err := os.WriteFile(caFile, clientCA.certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	trusted, stranger := clientCert(t, clientCA, "trusted"), clientCert(t, strangerCA, "stranger")
+
+	type result struct {
+		refused  bool
+		verified bool
+		certs    int
+	}
+	for _, tc := range []struct {
+		name   string
+		mode   string
+		caFile string
+		certs  []tls.Certificate
+		want   result
+	}{
+		{"require without a cert", ClientAuthRequire, caFile, nil, result{refused: true}},
+		{"require with a stranger", ClientAuthRequire, caFile, []tls.Certificate{stranger}, result{refused: true}},
+		{"require with a trusted cert", ClientAuthRequire, caFile, []tls.Certificate{trusted}, result{verified: true, certs: 1}},
+		{"require any cert", ClientAuthRequire, "", []tls.Certificate{stranger}, result{certs: 1}},
+		{"request without a cert", ClientAuthRequest, caFile, nil, result{}},
+		{"request with a stranger", ClientAuthRequest, caFile, []tls.Certificate{stranger}, result{certs: 1}},
+		{"request with a trusted cert", ClientAuthRequest, caFile, []tls.Certificate{trusted}, result{verified: true, certs: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &tls.Config{GetCertificate: serverCA.getCertificate}
+			pool, err := configureClientAuth(config, tc.mode, tc.caFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := newCaptureEnv(newMemStore(), "9000")
+			env.clientCAs = pool
+			completed := completions(t, env)
+			addr := tlsCaptureServer(t, env, "/mtls", config)
+
+			resp, err := trusting(serverCA, "localhost", tc.certs...).Get("https://" + addr + "/mtls")
+			if err == nil {
+				resp.Body.Close()
+			}
+			if refused := err != nil; refused || tc.want.refused {
+				if refused != tc.want.refused {
+					t.Errorf("got error %v, want refused: %v", err, tc.want.refused)
+				}
+				return
+			}
+			info := waitCompleted(t, completed).TLS
+			got := result{verified: info.ClientVerified, certs: len(info.ClientCertificates)}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+			// a certificate that was checked and failed says why
+			if pool != nil && got.certs > 0 && !got.verified && info.ClientVerifyError == "" {
+				t.Error("the failed verification has no error")
+			}
+			if got.certs > 0 && !strings.Contains(info.ClientCertificates[0].Subject, "CN=") {
+				t.Errorf("got subject %q, want the certificate details", info.ClientCertificates[0].Subject)
+			}
+		})
+	}
+}
+
+func TestConfigureClientAuthErrors(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	os.WriteFile(caFile, []byte("not a certificate"), 0o644)
+	for _, tc := range []struct {
+		mode, caFile string
+	}{
+		{"sometimes", ""},
+		{ClientAuthRequire, caFile},
+		{ClientAuthRequire, filepath.Join(filepath.Dir(caFile), "missing.pem")},
+	} {
+		if _, err := configureClientAuth(&tls.Config{}, tc.mode, tc.caFile); err == nil {
+			t.Errorf("mode %q with %s was accepted", tc.mode, tc.caFile)
+		}
+	}
+	ca, err := newCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(caFile, ca.certPEM, 0o644)
+	if _, err := configureClientAuth(&tls.Config{}, ClientAuthNone, caFile); err == nil {
+		t.Error("a client CA was accepted without asking clients for certificates")
+	}
+}
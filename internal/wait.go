@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWaitTimeout is how long a wait query blocks when the client does not ask for a timeout
+const DefaultWaitTimeout = time.Second * 30
+
+// MaxWaitTimeout caps how long a single wait query can block
+const MaxWaitTimeout = time.Minute * 5
+
+// captureNotifier wakes up everyone waiting for a new capture.
+// Waiters grab the current channel, which is closed and replaced whenever a request is captured.
+type captureNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newCaptureNotifier() *captureNotifier {
+	return &captureNotifier{ch: make(chan struct{})}
+}
+
+// wait returns a channel that is closed on the next capture
+func (n *captureNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// notify wakes up all current waiters
+func (n *captureNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+type headerMatcher struct {
+	name  string
+	value string
+	any   bool // only the presence of the header is checked
+}
+
+// requestMatcher selects captured requests, empty fields match everything
+type requestMatcher struct {
+	path    string
+	prefix  string
+	method  string
+	headers []headerMatcher
+	body    string
+	since   time.Time
+	until   time.Time
+	bin     string
+}
+
+// newRequestMatcher reads a matcher from query params:
+// path, prefix, method, header (Name or Name:value, repeatable), body (substring), since and until (RFC3339)
+// and bin (a bin id)
+func newRequestMatcher(q url.Values) (requestMatcher, error) {
+	m := requestMatcher{
+		path:   q.Get("path"),
+		prefix: q.Get("prefix"),
+		method: strings.ToUpper(q.Get("method")),
+		body:   q.Get("body"),
+		bin:    q.Get("bin"),
+	}
+	for _, h := range q["header"] {
+		name, value, found := strings.Cut(h, ":")
+		m.headers = append(m.headers, headerMatcher{
+			name:  http.CanonicalHeaderKey(strings.TrimSpace(name)),
+			value: strings.TrimSpace(value),
+			any:   !found,
+		})
+	}
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return m, fmt.Errorf("invalid since time: %s (use RFC3339)", since)
+		}
+		m.since = t
+	}
+	if until := q.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339Nano, until)
+		if err != nil {
+			return m, fmt.Errorf("invalid until time: %s (use RFC3339)", until)
+		}
+		m.until = t
+	}
+	return m, nil
+}
+
+func (m requestMatcher) matches(path string, cr *CapturedRequest) bool {
+	if m.path != "" && m.path != path {
+		return false
+	}
+	if !strings.HasPrefix(path, m.prefix) {
+		return false
+	}
+	if m.bin != "" && !strings.HasPrefix(path, binPrefix+m.bin+"/") {
+		return false
+	}
+	if m.method != "" && m.method != cr.Method {
+		return false
+	}
+	if !m.since.IsZero() && cr.ReceivedAt.Before(m.since) {
+		return false
+	}
+	if !m.until.IsZero() && cr.ReceivedAt.After(m.until) {
+		return false
+	}
+	for _, hm := range m.headers {
+		values, ok := cr.Header[hm.name]
+		if !ok {
+			return false
+		}
+		if hm.any {
+			continue
+		}
+		matched := false
+		for _, v := range values {
+			if v == hm.value {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if m.body != "" && !bytes.Contains(cr.Body, []byte(m.body)) {
+		return false
+	}
+	return true
+}
+
+// each calls f with every stored request that matches, in no particular order
+func (m requestMatcher) each(store storage, f func(path string, cr *CapturedRequest)) {
+	collect := func(key string, values []*CapturedRequest) {
+		for _, v := range values {
+			if m.matches(key, v) {
+				f(key, v)
+			}
+		}
+	}
+	if m.path != "" {
+		collect(m.path, store.load(m.path))
+	} else {
+		store.foreach(func(key string, values []*CapturedRequest) bool {
+			collect(key, values)
+			return true
+		})
+	}
+}
+
+// find returns all stored requests that match, oldest first
+func (m requestMatcher) find(store storage) []apiRequest {
+	found := []apiRequest{}
+	m.each(store, func(path string, cr *CapturedRequest) {
+		found = append(found, newAPIRequest(path, cr))
+	})
+	sortAPIRequests(found)
+	return found
+}
+
+type apiWaitTimeout struct {
+	Error    string       `json:"error"`
+	Requests []apiRequest `json:"requests"`
+}
+
+// waitHandler blocks until count matching requests have been captured or the timeout elapses.
+// It responds with the matched requests, or a 408 with whatever matched so far on timeout.
+func waitHandler(store storage, notifier *captureNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		m, err := newRequestMatcher(q)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		count := 1
+		if c := q.Get("count"); c != "" {
+			count, err = strconv.Atoi(c)
+			if err != nil || count < 1 {
+				writeError(w, http.StatusBadRequest, "invalid count: "+c)
+				return
+			}
+		}
+		timeout := DefaultWaitTimeout
+		if t := q.Get("timeout"); t != "" {
+			timeout, err = time.ParseDuration(t)
+			if err != nil || timeout < 0 {
+				writeError(w, http.StatusBadRequest, "invalid timeout: "+t+" (use go time.duration format. Eg: 10s)")
+				return
+			}
+		}
+		if timeout > MaxWaitTimeout {
+			timeout = MaxWaitTimeout
+		}
+
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		for {
+			// grab the channel before looking so a capture in between is not missed
+			next := notifier.wait()
+			found := m.find(store)
+			if len(found) >= count {
+				writeJSON(w, http.StatusOK, found[:count])
+				return
+			}
+			select {
+			case <-next:
+			case <-deadline.C:
+				writeJSON(w, http.StatusRequestTimeout, apiWaitTimeout{
+					Error:    fmt.Sprintf("timed out after %v waiting for %d requests, found %d", timeout, count, len(found)),
+					Requests: found,
+				})
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestWaitTimeout(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	env.capture("/hooks", testRequest("first"))
+	srv := apiServer(t, env)
+
+	resp, err := http.Get(srv.URL + "/api/v1/wait?" + url.Values{"path": {"/hooks"}, "count": {"2"}, "timeout": {"50ms"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	var timedOut apiWaitTimeout
+	if err := json.NewDecoder(resp.Body).Decode(&timedOut); err != nil {
+		t.Fatal(err)
+	}
+	if len(timedOut.Requests) != 1 || timedOut.Requests[0].ID != "first" || timedOut.Error == "" {
+		t.Errorf("got %+v, want the error with the one request found", timedOut)
+	}
+}
+
+func TestWaitForCapture(t *testing.T) {
+	env := newCaptureEnv(newMemStore(), "9000")
+	srv := apiServer(t, env)
+
+	// the capture may land before or after the wait starts looking, either way it is found
+	go func() {
+		env.capture("/other", testRequest("other"))
+		env.capture("/hooks", testRequest("hooked"))
+	}()
+	var reqs []apiRequest
+	status := getJSON(t, srv.URL+"/api/v1/wait?"+url.Values{"path": {"/hooks"}, "timeout": {"5s"}}.Encode(), &reqs)
+	if status != http.StatusOK || len(reqs) != 1 || reqs[0].ID != "hooked" {
+		t.Errorf("got status %d with %+v, want the request captured on /hooks", status, reqs)
+	}
+}
+
+func TestRequestMatcher(t *testing.T) {
+	cr := testRequest("1")
+	cr.Header = http.Header{"X-Token": {"a", "b"}}
+	for _, tc := range []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"path=/hammer", true},
+		{"path=/ham", false},
+		{"prefix=/ham", true},
+		{"method=post", true},
+		{"method=GET", false},
+		{"header=x-token", true},
+		{"header=X-Token:b", true},
+		{"header=X-Token:c", false},
+		{"header=X-Other", false},
+		{"body=of+1", true},
+		{"body=of+2", false},
+		{"since=2000-01-01T00:00:00Z&until=2999-01-01T00:00:00Z", true},
+		{"until=2000-01-01T00:00:00Z", false},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		m, err := newRequestMatcher(q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if got := m.matches(cr.Path, cr); got != tc.want {
+			t.Errorf("%q matches: %v, want %v", tc.query, got, tc.want)
+		}
+	}
+	if _, err := newRequestMatcher(url.Values{"since": {"yesterday"}}); err == nil {
+		t.Error("an invalid since time was accepted")
+	}
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsCloseTimeout is how long flytrap waits for the client to answer a close it sent
+const wsCloseTimeout = time.Second * 5
+
+// maxWSRecordedFrames caps the frames kept for a single websocket connection, later frames are only counted
+const maxWSRecordedFrames = 1000
+
+// WebSocketSession is the conversation on a websocket opened on a capture path
+type WebSocketSession struct {
+	Subprotocol   string           `json:"subprotocol,omitempty"`
+	Frames        []WebSocketFrame `json:"frames"`
+	FramesDropped int              `json:"framesDropped,omitempty"` // frames past maxWSRecordedFrames
+	ClosedAt      *time.Time       `json:"closedAt,omitempty"`
+}
+
+// truncated returns a copy of the session with frame payloads cut down to max bytes,
+// or the session itself if they already fit
+func (ws *WebSocketSession) truncated(max int64) *WebSocketSession {
+	if ws == nil {
+		return nil
+	}
+	var t *WebSocketSession
+	for i, f := range ws.Frames {
+		if int64(len(f.Payload)) <= max {
+			continue
+		}
+		if t == nil {
+			copied := *ws
+			copied.Frames = append([]WebSocketFrame(nil), ws.Frames...)
+			t = &copied
+		}
+		t.Frames[i].Payload = f.Payload[:max:max]
+		t.Frames[i].Truncated = true
+	}
+	if t == nil {
+		return ws
+	}
+	return t
+}
+
+// WebSocketFrame is a single frame sent by the client (in) or by flytrap (out)
+type WebSocketFrame struct {
+	Direction   string    `json:"direction"`
+	Type        string    `json:"type"`
+	Fin         bool      `json:"fin"`
+	Payload     []byte    `json:"payload,omitempty"`
+	Truncated   bool      `json:"truncated,omitempty"`
+	CloseCode   int       `json:"closeCode,omitempty"`
+	CloseReason string    `json:"closeReason,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// Directions of a websocket frame
+const (
+	wsDirectionIn  = "in"
+	wsDirectionOut = "out"
+)
+
+func wsFrameType(opcode byte) string {
+	switch opcode {
+	case wsContinuation:
+		return "continuation"
+	case wsText:
+		return "text"
+	case wsBinary:
+		return "binary"
+	case wsClose:
+		return "close"
+	case wsPing:
+		return "ping"
+	case wsPong:
+		return "pong"
+	}
+	return fmt.Sprintf("0x%x", opcode)
+}
+
+// String renders the frame as a line of the conversation
+func (f WebSocketFrame) String() string {
+	arrow := "<-"
+	if f.Direction == wsDirectionOut {
+		arrow = "->"
+	}
+	line := fmt.Sprintf("%s %s %s", f.At.Format(time.StampMilli), arrow, f.Type)
+	switch {
+	case f.Type == "close":
+		line += fmt.Sprintf(" %d %s", f.CloseCode, f.CloseReason)
+	case f.Type == "binary":
+		line += " " + base64.StdEncoding.EncodeToString(f.Payload)
+	case len(f.Payload) > 0:
+		line += " " + string(f.Payload)
+	}
+	return line
+}
+
+// wsScript is how flytrap talks back on a websocket, configured with the mock response of a path.
+// Messages are sent once the connection is open, each incoming message gets the first reply that matches it,
+// or is echoed back with Echo. Close ends the connection once the messages have been sent.
+type wsScript struct {
+	Subprotocol string      `json:"subprotocol,omitempty"`
+	Echo        bool        `json:"echo,omitempty"`
+	Messages    []wsMessage `json:"messages,omitempty"`
+	Replies     []wsReply   `json:"replies,omitempty"`
+	Close       *wsClosing  `json:"close,omitempty"`
+}
+
+type wsMessage struct {
+	Text   string   `json:"text,omitempty"`
+	Binary []byte   `json:"binary,omitempty"` // base64 in json
+	Delay  duration `json:"delay,omitempty"`
+}
+
+type wsReply struct {
+	Match string `json:"match,omitempty"` // a substring of the incoming message, empty matches every message
+	wsMessage
+}
+
+type wsClosing struct {
+	Code   int      `json:"code,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Delay  duration `json:"delay,omitempty"`
+}
+
+func (m wsMessage) frame() (byte, []byte) {
+	if m.Binary != nil {
+		return wsBinary, m.Binary
+	}
+	return wsText, []byte(m.Text)
+}
+
+// wsSession runs a websocket on a capture path, recording every frame on the captured request
+type wsSession struct {
+	conn   *wsConn
+	script *wsScript
+	resp   *CapturedResponse
+	record func(*CapturedResponse, *WebSocketSession) // called with a copy of the session after every frame
+
+	mu        sync.Mutex
+	session   WebSocketSession
+	closeSent bool // a close from the client after this answers it and gets no reply
+}
+
+// serveWebsocket completes the upgrade and runs the conversation until either side closes the connection.
+// It returns the handshake response and the finished session, or nils if the upgrade failed and an error
+// was written instead.
+func serveWebsocket(w http.ResponseWriter, r *http.Request, script *wsScript,
+	record func(*CapturedResponse, *WebSocketSession)) (*CapturedResponse, *WebSocketSession) {
+	if script == nil {
+		script = &wsScript{}
+	}
+	subprotocol := ""
+	if script.Subprotocol != "" && headerHasToken(r.Header, "Sec-WebSocket-Protocol", script.Subprotocol) {
+		subprotocol = script.Subprotocol
+	}
+	started := time.Now()
+	conn, err := upgradeWebsocket(w, r, subprotocol)
+	if err != nil {
+		log.Printf("Capture websocket upgrade failed on path: %s error: %v", r.URL.Path, err)
+		return nil, nil
+	}
+	defer conn.Close()
+
+	header := http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}
+	if subprotocol != "" {
+		header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	s := &wsSession{
+		conn:    conn,
+		script:  script,
+		resp:    &CapturedResponse{Status: http.StatusSwitchingProtocols, Proto: "HTTP/1.1", Header: header, Latency: time.Since(started)},
+		record:  record,
+		session: WebSocketSession{Subprotocol: subprotocol, Frames: []WebSocketFrame{}},
+	}
+	s.mu.Lock()
+	s.save()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go s.play(done)
+	s.read()
+	close(done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closed := time.Now()
+	s.session.ClosedAt = &closed
+	return s.resp, &s.session
+}
+
+// play sends the scripted messages, and closes the connection if the script says so
+func (s *wsSession) play(done <-chan struct{}) {
+	wait := func(d duration) bool {
+		select {
+		case <-time.After(time.Duration(d)):
+			return true
+		case <-done:
+			return false
+		}
+	}
+	for _, m := range s.script.Messages {
+		if !wait(m.Delay) {
+			return
+		}
+		opcode, payload := m.frame()
+		if s.send(opcode, payload) != nil {
+			return
+		}
+	}
+	if c := s.script.Close; c != nil && wait(c.Delay) {
+		code := c.Code
+		if code == 0 {
+			code = wsCloseNormal
+		}
+		s.sendClose(code, c.Reason)
+	}
+}
+
+// read records what the client sends and replies to it until the connection is closed.
+// A message sent in fragments is put back together and replied to once its last fragment arrives.
+func (s *wsSession) read() {
+	var msg wsFrame // the message being received, its opcode is 0 between messages
+	for {
+		f, err := s.conn.readFrame()
+		if err != nil {
+			return
+		}
+		s.add(wsDirectionIn, f.opcode, f.fin, f.payload)
+		switch f.opcode {
+		case wsPing:
+			s.send(wsPong, f.payload)
+		case wsClose:
+			s.mu.Lock()
+			answered := s.closeSent
+			s.mu.Unlock()
+			if answered {
+				return
+			}
+			code, _ := parseWSClose(f.payload)
+			if code == wsCloseNoStatus {
+				code = wsCloseNormal
+			}
+			s.sendClose(code, "")
+			return
+		case wsText, wsBinary, wsContinuation:
+			if (f.opcode == wsContinuation) != (msg.opcode != 0) {
+				s.sendClose(wsCloseProtocolError, "unexpected fragment")
+				return
+			}
+			if f.opcode != wsContinuation {
+				msg = wsFrame{opcode: f.opcode}
+			}
+			if len(msg.payload)+len(f.payload) > maxWSFramePayload {
+				s.sendClose(wsCloseTooBig, "message too large")
+				return
+			}
+			msg.payload = append(msg.payload, f.payload...)
+			if f.fin {
+				s.reply(msg)
+				msg = wsFrame{}
+			}
+		}
+	}
+}
+
+// reply answers a whole message from the client
+func (s *wsSession) reply(msg wsFrame) {
+	for _, rep := range s.script.Replies {
+		if strings.Contains(string(msg.payload), rep.Match) {
+			opcode, payload := rep.frame()
+			s.send(opcode, payload)
+			return
+		}
+	}
+	if s.script.Echo {
+		s.send(msg.opcode, msg.payload)
+	}
+}
+
+// errWSClosing stops frames from being sent after the close, which has to be the last one
+var errWSClosing = errors.New("the websocket is closing")
+
+func (s *wsSession) send(opcode byte, payload []byte) error {
+	s.mu.Lock()
+	closing := s.closeSent
+	s.mu.Unlock()
+	if closing {
+		return errWSClosing
+	}
+	if err := s.conn.writeFrame(opcode, payload); err != nil {
+		return err
+	}
+	s.add(wsDirectionOut, opcode, true, payload)
+	return nil
+}
+
+func (s *wsSession) sendClose(code int, reason string) {
+	s.mu.Lock()
+	s.closeSent = true
+	s.mu.Unlock()
+	if s.conn.writeClose(code, reason) == nil {
+		payload := []byte{byte(code >> 8), byte(code)}
+		s.add(wsDirectionOut, wsClose, true, append(payload, reason...))
+	}
+	// don't wait forever for a client that doesn't answer the close
+	s.conn.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+}
+
+func (s *wsSession) add(direction string, opcode byte, fin bool, payload []byte) {
+	f := WebSocketFrame{Direction: direction, Type: wsFrameType(opcode), Fin: fin, Payload: payload, At: time.Now()}
+	if opcode == wsClose {
+		f.CloseCode, f.CloseReason = parseWSClose(payload)
+		f.Payload = nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.session.Frames) >= maxWSRecordedFrames {
+		s.session.FramesDropped++
+		return
+	}
+	s.session.Frames = append(s.session.Frames, f)
+	s.save()
+}
+
+// save hands a copy of the session to record, frames are never changed once added so they can be shared.
+// It is called with mu held so the copies are recorded in order.
+func (s *wsSession) save() {
+	session := s.session
+	session.Frames = session.Frames[:len(session.Frames):len(session.Frames)]
+	s.record(s.resp, &session)
+}
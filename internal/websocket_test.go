@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dialWS opens a websocket to the test server, the frames flytrap sends are read with the server side reader
+func dialWS(t *testing.T, srv *httptest.Server, path string) (net.Conn, *wsConn) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: flytrap\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// the accept key of the example handshake in RFC 6455
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got accept key %q", got)
+	}
+	return conn, &wsConn{conn: conn, br: br}
+}
+
+// writeMasked sends a final frame the way clients must, masked
+func writeMasked(conn net.Conn, opcode byte, payload []byte) error {
+	return writeFragment(conn, true, opcode, payload)
+}
+
+func writeFragment(conn net.Conn, fin bool, opcode byte, payload []byte) error {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{opcode}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+func TestReadFrameUnmasks(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	payload := make([]byte, 300)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	go writeMasked(client, wsBinary, payload)
+
+	f, err := (&wsConn{conn: server, br: bufio.NewReader(server)}).readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.fin || f.opcode != wsBinary || string(f.payload) != string(payload) {
+		t.Errorf("got frame fin: %v opcode: %d with %d bytes, want the binary frame sent", f.fin, f.opcode, len(f.payload))
+	}
+}
+
+func TestWSStreamClose(t *testing.T) {
+	srv := httptest.NewServer(wsStreamHandler(newBroker()))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    int
+	}{
+		// an empty close frame reads as 1005, which must not be sent back
+		{"empty", nil, wsCloseNormal},
+		{"going away", binary.BigEndian.AppendUint16(nil, wsCloseGoingAway), wsCloseGoingAway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, ws := dialWS(t, srv, "/api/v1/ws")
+			if err := writeMasked(conn, wsClose, tc.payload); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				f, err := ws.readFrame()
+				if err != nil {
+					t.Fatalf("reading the close reply: %v", err)
+				}
+				if f.opcode != wsClose {
+					continue
+				}
+				if code, _ := parseWSClose(f.payload); code != tc.want {
+					t.Errorf("got close code %d, want %d", code, tc.want)
+				}
+				return
+			}
+		})
+	}
+}
+
+// wsCaptureServer runs a websocket on every request with script, handing over each finished session
+func wsCaptureServer(t *testing.T, script *wsScript) (*httptest.Server, chan *WebSocketSession) {
+	sessions := make(chan *WebSocketSession, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, session := serveWebsocket(w, r, script, func(*CapturedResponse, *WebSocketSession) {})
+		sessions <- session
+	}))
+	t.Cleanup(srv.Close)
+	return srv, sessions
+}
+
+func TestWSCaptureFragments(t *testing.T) {
+	srv, _ := wsCaptureServer(t, &wsScript{Echo: true})
+	conn, ws := dialWS(t, srv, "/frag")
+	writeFragment(conn, false, wsText, []byte("hel"))
+	// control frames can come between the fragments
+	writeMasked(conn, wsPing, []byte("p"))
+	writeFragment(conn, true, wsContinuation, []byte("lo"))
+
+	var got []wsFrame
+	for len(got) < 2 {
+		f, err := ws.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, f)
+	}
+	if got[0].opcode != wsPong || got[1].opcode != wsText || string(got[1].payload) != "hello" {
+		t.Errorf("got %+v, want the pong then the whole message echoed once", got)
+	}
+}
+
+func TestWSCaptureScriptedClose(t *testing.T) {
+	srv, sessions := wsCaptureServer(t, &wsScript{Close: &wsClosing{Code: wsCloseGoingAway}})
+	conn, ws := dialWS(t, srv, "/close")
+	f, err := ws.readFrame()
+	if err != nil || f.opcode != wsClose {
+		t.Fatalf("got %+v %v, want the scripted close", f, err)
+	}
+	writeMasked(conn, wsClose, f.payload)
+
+	// the client's answer ends the connection without another close
+	if f, err := ws.readFrame(); err == nil {
+		t.Errorf("got frame %+v after the close handshake, want the connection closed", f)
+	}
+	var closes int
+	for _, f := range (<-sessions).Frames {
+		if f.Direction == wsDirectionOut && f.Type == "close" {
+			closes++
+		}
+	}
+	if closes != 1 {
+		t.Errorf("flytrap sent %d closes, want 1", closes)
+	}
+}
+
+func TestWSStreamEvents(t *testing.T) {
+	b := newBroker()
+	srv := httptest.NewServer(wsStreamHandler(b))
+	defer srv.Close()
+	_, ws := dialWS(t, srv, "/api/v1/ws")
+
+	// the subscription starts after the handshake, publish until it gets there
+	received := make(chan struct{})
+	defer close(received)
+	go func() {
+		for {
+			b.publish(eventResponse, "/hooks", testRequest("1"))
+			select {
+			case <-received:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	f, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct {
+		Event string
+		Data  apiRequest
+	}
+	if err := json.Unmarshal(f.payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Event != eventResponse || msg.Data.ID != "1" || msg.Data.Path != "/hooks" {
+		t.Errorf("got %s, want the response event of request 1", f.payload)
+	}
+}